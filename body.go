@@ -10,16 +10,22 @@ import (
 import "C"
 
 type requestBody struct {
-	handler commandHandler
-	started bool
-	curBuf  []byte
+	handler    commandHandler
+	started    bool
+	curBuf     []byte
+	undeclared bool
+	ended      bool
 }
 
 func (b *requestBody) Read(buf []byte) (int, error) {
+	if b.undeclared {
+		// The caller was told that we never read the body, so don't ask for it.
+		return 0, errBodyNotDeclared
+	}
 	if !b.started {
 		b.handler.StartRead()
 		// First tell the caller that we need some data.
-		b.handler.Commands() <- command{id: RBOD}
+		b.handler.SendCommand(command{id: RBOD})
 		b.started = true
 	}
 
@@ -30,6 +36,11 @@ func (b *requestBody) Read(buf []byte) (int, error) {
 	}
 
 	if cb == nil {
+		if !b.ended {
+			// Trailers must be in place before the reader sees EOF.
+			b.handler.EndRead()
+			b.ended = true
+		}
 		return 0, io.EOF
 	}
 
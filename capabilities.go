@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/30x/gozerian/pipeline"
+)
+
+// Capability is a bit mask that describes which parts of a message a pipeline
+// needs to see. The values must match the GO_CAP_ macros in gobridge.go.
+type Capability uint32
+
+const (
+	// RequestHeaders means that the pipeline needs the request line and headers.
+	RequestHeaders Capability = 1 << iota
+	// RequestBody means that the pipeline reads the request body.
+	RequestBody
+	// ResponseHeaders means that the pipeline needs the response status and headers.
+	ResponseHeaders
+	// ResponseBody means that the pipeline reads the response body.
+	ResponseBody
+	// Subrequests means that the pipeline makes subrequests.
+	Subrequests
+
+	// AllCapabilities is what we assume for a pipeline that does not say.
+	AllCapabilities = RequestHeaders | RequestBody | ResponseHeaders | ResponseBody | Subrequests
+)
+
+var errBodyNotDeclared = errors.New("Pipeline did not declare that it reads the message body")
+var errSubrequestsNotDeclared = errors.New("Pipeline did not declare that it makes subrequests")
+
+// CapabilityDefinition may be implemented by a pipeline.Definition in order
+// to declare which phases and message bodies its pipes use. The result is a
+// combination of the Capability bits. It is a plain uint32 so that pipelines
+// outside this package can implement it. Hosts may skip any phase that the
+// pipeline does not need.
+type CapabilityDefinition interface {
+	Capabilities() uint32
+}
+
+func capabilitiesOf(pd pipeline.Definition) Capability {
+	if cd, ok := pd.(CapabilityDefinition); ok {
+		return Capability(cd.Capabilities())
+	}
+	return AllCapabilities
+}
+
+func (c Capability) has(o Capability) bool {
+	return c&o == o
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"encoding/binary"
+	"net/http"
+	"strconv"
+)
+
 //go:generate stringer -type=CommandID
 
 // Mapping of command IDs to names is generated by stringer -- re run
@@ -33,6 +39,40 @@ const (
 	// WBOD indicates that the request or response body is being rewritten and should
 	// be replaced with the chunks identified by this command.
 	WBOD
+	// HADD indicates that a value must be added to a header. It is only sent to
+	// callers that have enabled header deltas on the handler.
+	HADD
+	// HSET indicates that all the values of a header must be replaced with a
+	// single new value.
+	HSET
+	// HDEL indicates that a header must be removed.
+	HDEL
+	// WTRL indicates that the trailers that follow the request or response body
+	// must be replaced with the new values.
+	WTRL
+	// WVAR indicates that the pipeline set a variable, which the caller may
+	// want to store.
+	WVAR
+	// WMTH indicates that the method of the request must change
+	WMTH
+	// WTGT indicates that the request must go to a different upstream server,
+	// without changing the URI
+	WTGT
+	// WLOG carries a message that the pipeline logged, for the log of the
+	// caller.
+	WLOG
+	// SUBR asks the caller to make an HTTP request for the pipeline and to
+	// pass the response back.
+	SUBR
+	// IRDR indicates that the caller must hand the request to a different
+	// location of its own, instead of the target or the current response.
+	IRDR
+	// RTRY indicates that the response must be thrown away and the request
+	// sent to the target again.
+	RTRY
+	// WINF indicates that the caller must send an informational response,
+	// such as 103 Early Hints, before the final one.
+	WINF
 )
 
 const (
@@ -44,21 +84,138 @@ const (
 	cmdWsta = "WSTA"
 	cmdSwch = "SWCH"
 	cmdWbod = "WBOD"
+	cmdHadd = "HADD"
+	cmdHset = "HSET"
+	cmdHdel = "HDEL"
+	cmdWtrl = "WTRL"
+	cmdWvar = "WVAR"
+	cmdWmth = "WMTH"
+	cmdWtgt = "WTGT"
+	cmdWlog = "WLOG"
+	cmdSubr = "SUBR"
+	cmdIrdr = "IRDR"
+	cmdRtry = "RTRY"
+	cmdWinf = "WINF"
 )
 
+/*
+ * needsCaller returns true for commands after which the pipeline cannot make
+ * any progress until the caller has done something, either because the
+ * caller has to respond or because there is nothing more to do.
+ */
+func (c CommandID) needsCaller() bool {
+	switch c {
+	case DONE, ERRR, RBOD, SUBR:
+		return true
+	default:
+		return false
+	}
+}
+
 type command struct {
 	id  CommandID
 	msg string
+	// For WBOD, the chunk ID that "msg" contains in hex
+	chunkID int32
+}
+
+/*
+ * An error that knows which HTTP status the caller should send because of it.
+ * Any other error is a 500.
+ */
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+/*
+ * Attach a status to an error, unless it already has one.
+ */
+func withStatus(status int, err error) error {
+	if _, ok := err.(*httpError); ok {
+		return err
+	}
+	return &httpError{status: status, err: err}
+}
+
+func errorStatus(err error) int {
+	if he, ok := err.(*httpError); ok {
+		return he.status
+	}
+	return http.StatusInternalServerError
 }
 
-func createErrorCommand(err error) command {
+/*
+ * The message of an ERRR command is the error message. Callers that have set
+ * the "errorStatus" option get the suggested HTTP status in front of it.
+ */
+func createErrorCommand(err error, includeStatus bool) command {
+	msg := err.Error()
+	if includeStatus {
+		msg = strconv.Itoa(errorStatus(err)) + " " + msg
+	}
 	return command{
 		id:  ERRR,
-		msg: err.Error(),
+		msg: msg,
 	}
 }
 
+/*
+ * Split an ERRR message into the status and the error message. An ERRR for
+ * an unknown request or response has no status, since there is no handler
+ * to say whether it should, so the status is 500 unless there is one.
+ */
+func parseErrorMessage(msg string) (int, string) {
+	if len(msg) > 4 && msg[3] == ' ' {
+		if status, err := strconv.Atoi(msg[:3]); err == nil && status >= 100 {
+			return status, msg[4:]
+		}
+	}
+	return http.StatusInternalServerError, msg
+}
+
 func (c command) String() string {
 	pfx := c.id.String()
 	return pfx + c.msg
 }
+
+const (
+	// The size of the fixed part of a frame
+	frameHeaderSize = 12
+	// Set in the flags of the last frame, which is DONE or ERRR
+	frameFlagLast = 1
+)
+
+/*
+ * Return the command in the binary framing. Each frame starts with the
+ * four-letter command code, followed by the flags and the length of the
+ * payload, as 32-bit integers in network byte order. The payload is the same
+ * as the rest of the text command, except that WBOD has the chunk ID as a
+ * 32-bit integer, again in network byte order. Since the payload has a
+ * length, it may contain NUL characters, and it is not terminated by one.
+ */
+func (c command) frame() []byte {
+	var payload []byte
+	if c.id == WBOD {
+		payload = make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(c.chunkID))
+	} else {
+		payload = []byte(c.msg)
+	}
+
+	var flags uint32
+	if c.id == DONE || c.id == ERRR {
+		flags |= frameFlagLast
+	}
+
+	buf := make([]byte, frameHeaderSize+len(payload))
+	copy(buf, c.id.String())
+	binary.BigEndian.PutUint32(buf[4:], flags)
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+	return buf
+}
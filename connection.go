@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const unixAddrPrefix = "unix:"
+
+/*
+ * Information about the client connection that a request arrived on. The
+ * caller knows this, but it is not part of the request headers, so it is
+ * passed in separately before the request begins.
+ */
+type connectionInfo struct {
+	remoteAddr string
+	localAddr  net.Addr
+	tls        *tls.ConnectionState
+}
+
+/*
+ * Build the connection info from what the caller passed. Addresses are in
+ * "host:port" form, or "unix:" followed by a path for a Unix domain socket,
+ * and either one may be empty. If "tlsVersion" is zero, then the connection
+ * does not use TLS and the rest of the parameters are ignored. "peerCerts"
+ * is the PEM-encoded chain presented by the client, leaf first. If
+ * "verified" is set, then the caller has already verified the chain, and it
+ * is also reported as the verified chain.
+ */
+func newConnectionInfo(
+	remoteAddr, localAddr string,
+	tlsVersion, cipherSuite uint16, serverName, peerCerts string,
+	verified bool) (*connectionInfo, error) {
+
+	ci := &connectionInfo{
+		remoteAddr: remoteAddr,
+	}
+
+	if remoteAddr != "" {
+		// RemoteAddr is only a string, so it's passed on as it is.
+		_, err := parseAddr(remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if localAddr != "" {
+		addr, err := parseAddr(localAddr)
+		if err != nil {
+			return nil, err
+		}
+		ci.localAddr = addr
+	}
+
+	if tlsVersion == 0 {
+		return ci, nil
+	}
+
+	certs, err := parsePEMCertificates(peerCerts)
+	if err != nil {
+		return nil, err
+	}
+	ci.tls = &tls.ConnectionState{
+		Version:           tlsVersion,
+		HandshakeComplete: true,
+		CipherSuite:       cipherSuite,
+		ServerName:        serverName,
+		PeerCertificates:  certs,
+	}
+	if verified && len(certs) > 0 {
+		ci.tls.VerifiedChains = [][]*x509.Certificate{certs}
+	}
+	return ci, nil
+}
+
+/*
+ * Return a copy of the request that has the connection info in it. The
+ * original request is not changed.
+ */
+func (ci *connectionInfo) apply(req *http.Request) *http.Request {
+	ctx := req.Context()
+	if ci.localAddr != nil {
+		ctx = context.WithValue(ctx, http.LocalAddrContextKey, ci.localAddr)
+	}
+	r := req.WithContext(ctx)
+	r.RemoteAddr = ci.remoteAddr
+	r.TLS = ci.tls
+	return r
+}
+
+/*
+ * The default scheme for requests on this connection.
+ */
+func (ci *connectionInfo) scheme() string {
+	if ci != nil && ci.tls != nil {
+		return "https"
+	}
+	return "http"
+}
+
+/*
+ * Nginx, like most servers, describes a client on a Unix domain socket as
+ * "unix:" followed by the path of the socket, which may be empty.
+ */
+func parseAddr(s string) (net.Addr, error) {
+	if strings.HasPrefix(s, unixAddrPrefix) {
+		return &net.UnixAddr{Name: s[len(unixAddrPrefix):], Net: "unix"}, nil
+	}
+	return parseTCPAddr(s)
+}
+
+/*
+ * An IPv6 address may have a zone, as in "[fe80::1%eth0]:443."
+ */
+func parseTCPAddr(s string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	var zone string
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, fmt.Errorf("Invalid IP address: \"%s\"", s)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port: \"%s\"", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(portNum), Zone: zone}, nil
+}
+
+func parsePEMCertificates(raw string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(raw)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
@@ -1,6 +1,7 @@
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
+#include <arpa/inet.h>
 #include <CUnit/Basic.h>
 #include <libgozerian.h>
 #include "ctests.h"
@@ -171,6 +172,46 @@ static void test_replace_response_body_chunks(void) {
   cleanRequest();
 }
 
+static void test_sync_request(void) {
+  createHeader("POST", "/completeresponse", 13, "text/plain");
+  char* bod = "Hello, World!";
+  GoSyncResult* result = GoProcessRequestSync(TEST_HANDLER, hdrBuf, bod, strlen(bod));
+  CU_ASSERT_PTR_NOT_NULL_FATAL(result);
+  CU_ASSERT_PTR_NULL(result->error);
+  CU_ASSERT_NOT_EQUAL(result->requestID, 0);
+  CU_ASSERT_NOT_EQUAL(result->switched, 0);
+  CU_ASSERT_EQUAL(result->status, 201);
+  CU_ASSERT_PTR_NOT_NULL(result->headers);
+  CU_ASSERT_NOT_EQUAL(result->bodyChanged, 0);
+  CU_ASSERT_TRUE(strncmp("Hello Again! Time for a complete rewrite!",
+                         result->body, result->bodyLen) == 0);
+
+  GoFreeRequest(result->requestID);
+  GoFreeSyncResult(result);
+}
+
+static void test_sync_response(void) {
+  createHeader("GET", "/transformbody", 0, NULL);
+  GoSyncResult* result = GoProcessRequestSync(TEST_HANDLER, hdrBuf, NULL, 0);
+  CU_ASSERT_PTR_NOT_NULL_FATAL(result);
+  CU_ASSERT_PTR_NULL(result->error);
+  CU_ASSERT_EQUAL(result->switched, 0);
+  CU_ASSERT_EQUAL(result->bodyChanged, 0);
+  unsigned int reqID = result->requestID;
+  GoFreeSyncResult(result);
+
+  createResponse(10, "text/plain");
+  result = GoProcessResponseSync(TEST_HANDLER, reqID, 200, hdrBuf, "0123456789", 10);
+  CU_ASSERT_PTR_NOT_NULL_FATAL(result);
+  CU_ASSERT_PTR_NULL(result->error);
+  CU_ASSERT_NOT_EQUAL(result->bodyChanged, 0);
+  CU_ASSERT_TRUE(strncmp("We have transformed the response!",
+                         result->body, result->bodyLen) == 0);
+
+  GoFreeRequest(reqID);
+  GoFreeSyncResult(result);
+}
+
 static int seqChar(int last) {
   int ch = last;
   for (;;) {
@@ -329,6 +370,45 @@ static void concurrent_test(int concurrency) {
   free(rids);
 }
 
+static void test_binary_framing(void) {
+  char* err = GoCreateHandler("binary", "urn:weaver-proxy:unit-test");
+  CU_ASSERT_PTR_NULL(err);
+  err = GoSetHandlerOption("binary", "framing", "binary");
+  CU_ASSERT_PTR_NULL(err);
+
+  unsigned int bid = GoCreateRequest("binary");
+  CU_ASSERT_NOT_EQUAL(bid, 0);
+  createHeader("POST", "/replacebody", 100, "text/plain");
+  GoBeginRequest(bid, hdrBuf);
+
+  unsigned int frameLen;
+  char* frame = (char*)GoPollRequestFrame(bid, 1, &frameLen);
+  CU_ASSERT_PTR_NOT_NULL(frame);
+  CU_ASSERT_EQUAL(frameLen, GO_FRAME_HEADER_SIZE + 4);
+  CU_ASSERT_TRUE(strncmp("WBOD", frame, 4) == 0);
+  uint32_t chunkID;
+  memcpy(&chunkID, frame + GO_FRAME_HEADER_SIZE, 4);
+  chunkID = ntohl(chunkID);
+  free(frame);
+  char* chunk = (char*)GoGetChunk(chunkID);
+  CU_ASSERT_PTR_NOT_NULL(chunk);
+  unsigned int chunkLen = GoGetChunkLength(chunkID);
+  CU_ASSERT_TRUE(strncmp("Hello! I am the server!", chunk, chunkLen) == 0);
+  free(chunk);
+  GoReleaseChunk(chunkID);
+
+  frame = (char*)GoPollRequestFrame(bid, 1, &frameLen);
+  CU_ASSERT_EQUAL(frameLen, GO_FRAME_HEADER_SIZE);
+  CU_ASSERT_TRUE(strncmp("DONE", frame, 4) == 0);
+  uint32_t flags;
+  memcpy(&flags, frame + 4, 4);
+  CU_ASSERT_EQUAL(ntohl(flags), GO_FRAME_LAST);
+  free(frame);
+
+  GoFreeRequest(bid);
+  GoDestroyHandler("binary");
+}
+
 static void test_two_concurrent_requests(void) {
   concurrent_test(2);
 }
@@ -346,6 +426,9 @@ int addMainTests(CU_pSuite s) {
   CU_ADD_TEST(s, test_replace_response_body_binary);
   CU_ADD_TEST(s, test_replace_response_body_binary_multi);
   CU_ADD_TEST(s, test_replace_response_body_binary_larger);
+  CU_ADD_TEST(s, test_sync_request);
+  CU_ADD_TEST(s, test_sync_response);
+  CU_ADD_TEST(s, test_binary_framing);
   CU_ADD_TEST(s, test_two_concurrent_requests);
   CU_ADD_TEST(s, test_many_concurrent_requests);
   return 0;
@@ -1,12 +1,63 @@
 package main
 
 import (
+	"strings"
 	"sync"
+	"time"
 	"unsafe"
+
+	"github.com/30x/libgozerian/weaver"
 )
 
 /*
 #include <stdlib.h>
+
+#define GO_CAP_REQUEST_HEADERS  1
+#define GO_CAP_REQUEST_BODY     2
+#define GO_CAP_RESPONSE_HEADERS 4
+#define GO_CAP_RESPONSE_BODY    8
+#define GO_CAP_SUBREQUESTS      16
+
+#define GO_FRAME_HEADER_SIZE 12
+#define GO_FRAME_LAST        1
+
+#define GO_LOG_ERROR 0
+#define GO_LOG_WARN  1
+#define GO_LOG_INFO  2
+#define GO_LOG_DEBUG 3
+
+#define GO_UPSTREAM_UNREACHABLE 0
+#define GO_UPSTREAM_TIMEOUT     1
+#define GO_UPSTREAM_INVALID     2
+
+typedef struct {
+  unsigned int requestID;
+  char* error;
+  int switched;
+  unsigned int status;
+  char* uri;
+  char* headers;
+  int bodyChanged;
+  void* body;
+  unsigned int bodyLen;
+  char* reason;
+  char* method;
+  char* upstream;
+  char* logs;
+  char* redirect;
+  int retry;
+  char* informational;
+  char* trailers;
+  char* variables;
+} GoSyncResult;
+
+typedef struct {
+  unsigned int status;
+  long long bytesReceived;
+  long long bytesSent;
+  long long upstreamTime;
+  long long requestTime;
+} GoTransactionStats;
 */
 import "C"
 
@@ -18,6 +69,8 @@ const (
 	TestHandlerURIName = "weaver-proxy:unit-test"
 	// BadHandlerURIName is used to construct BadHandlerURI
 	BadHandlerURIName = "weaver-proxy:always-bad"
+	// HeadersOnlyHandlerURIName is used to construct HeadersOnlyHandlerURI
+	HeadersOnlyHandlerURIName = "weaver-proxy:headers-only"
 
 	// TestHandlerURI always refers to a special pipeline that does various things
 	// for the purposes of unit testing libgozerian.
@@ -25,6 +78,9 @@ const (
 	// BadHandlerURI always refers to a non-existent handler and is used for unit
 	// testing.
 	BadHandlerURI = urnPrefix + BadHandlerURIName
+	// HeadersOnlyHandlerURI refers to the unit test pipeline, but declares that
+	// it only looks at request headers.
+	HeadersOnlyHandlerURI = urnPrefix + HeadersOnlyHandlerURIName
 )
 
 // A global, thread-safe chunk table.
@@ -76,6 +132,99 @@ func GoDestroyHandler(handlerID *C.char) {
 	destroyHandler(C.GoString(handlerID))
 }
 
+/*
+GoSetHandlerOption sets an option on a handler that was created by
+GoCreateHandler. Options only affect requests and responses that are created
+after they are set. If the option could not be set, then a string describing
+the error is returned, and the caller must free it using "free." Otherwise,
+NULL is returned.
+
+The first parameter is the handler ID, and the second and third are the name
+and value of the option. The following options are supported:
+
+headerDeltas: If "true," then changes to headers on the proxy path are sent
+using the HADD, HSET and HDEL commands instead of replacing all the headers
+using WHDR. The default is "false." It has no effect on GoProcessRequestSync
+and GoProcessResponseSync.
+
+maxHeaders: The largest number of headers that a request may have. Requests
+with more fail with a 431 error. The default is 100, and zero means no limit.
+
+maxHeaderBytes: The largest size, in bytes, of the request line and headers
+passed to GoBeginRequest. Larger requests fail with a 431 error. The default
+is 1048576, and zero means no limit.
+
+errorStatus: If "true," then ERRR messages start with the HTTP status that the
+caller should send, such as 400 for an invalid request or 431 for one that
+breaks the limits above, followed by a space. The default is "false," in
+which case ERRR only has the error message.
+
+escapedHeaders: If "true," then the caller escapes the values of the headers
+passed to GoBeginResponse and GoSendSubrequestResponse, and of the trailers
+passed to GoSendRequestTrailers and GoSendResponseTrailers, in the same way
+as for WHDR. The default is "false," in which case those values are used
+exactly as they are, so a value such as "C:\new" is left alone.
+
+framing: Either "text" or "binary." With "binary," commands are returned by
+GoPollRequestFrame and GoPollResponseFrame instead of GoPollRequest and
+GoPollResponse. The default is "text."
+
+maxRetries: How many times the pipeline may retry a single request, using
+the RTRY command. The default is 1.
+
+outputPolicy: What to do when a pipeline produces a header, URI, reason
+phrase or variable that contains characters that are not allowed, such as
+CR and LF. "reject" fails the request or response with ERRR, "strip" removes
+the characters and "encode" replaces them with "%XX". The default is
+"reject."
+*/
+//export GoSetHandlerOption
+func GoSetHandlerOption(handlerID, name, value *C.char) *C.char {
+	err := setHandlerOption(C.GoString(handlerID), C.GoString(name), C.GoString(value))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoGetHandlerCapabilities returns a bit mask that describes what the pipeline
+for a handler needs to see. The bits are defined by the GO_CAP_ macros:
+
+GO_CAP_REQUEST_HEADERS: The pipeline needs the request line and headers.
+
+GO_CAP_REQUEST_BODY: The pipeline may read the request body. If this is not set,
+RBOD will never be sent on the request path and the caller need not buffer
+the request body.
+
+GO_CAP_RESPONSE_HEADERS: The pipeline needs the response status and headers.
+
+GO_CAP_RESPONSE_BODY: The pipeline may read the response body.
+
+GO_CAP_SUBREQUESTS: The pipeline may send SUBR. If neither this nor
+GO_CAP_REQUEST_BODY is set, then GoBeginRequest runs the pipeline on the
+calling thread.
+
+If neither of the response bits are set, then the caller may skip
+GoCreateResponse and GoBeginResponse entirely. If the handler does not exist,
+then zero is returned.
+*/
+//export GoGetHandlerCapabilities
+func GoGetHandlerCapabilities(handlerID *C.char) uint32 {
+	return uint32(getHandlerCapabilities(C.GoString(handlerID)))
+}
+
+/*
+GoSetLogLevel sets the most verbose level of message that pipelines may send
+using WLOG. It is one of GO_LOG_ERROR, GO_LOG_WARN, GO_LOG_INFO and
+GO_LOG_DEBUG, and applies to every handler. Messages at more verbose levels
+are dropped before they are sent. The default is GO_LOG_INFO.
+*/
+//export GoSetLogLevel
+func GoSetLogLevel(level int32) {
+	setLogLevel(weaver.Level(level))
+}
+
 /*
 GoCreateRequest creates a new "request" object and return its unique ID. The request
 goes in a map, so it's important that the caller always call
@@ -105,6 +254,8 @@ func GoCreateResponse(handlerID *C.char) uint32 {
 /*
 GoFreeRequest cleans up any storage used by the request. This method must be called for
 every ID generated by GoCreateRequest or there will be a memory leak.
+Any subrequests that the request is still waiting for fail, and their IDs
+may not be used again.
 */
 //export GoFreeRequest
 func GoFreeRequest(id uint32) {
@@ -186,18 +337,115 @@ request ID returned by "GoCreateRequest."
 
 The second parameter must be a string that
 represents the HTTP request line and headers, separated by CRLF pairs,
-exactly as described in the HTTP spec.
-
-Once this function has been called, the request is already running.
-The caller MUST periodically call "GoPollRequest" in order to get updates
-on the status of the request, and MUST call "GoFreeRequest" after
-the request is done.
+exactly as described in the HTTP spec. An HTTP/2 or HTTP/3 frontend may
+instead start with the pseudo-headers of the request, such as ":method" and
+":path," one per line in place of the request line, as described in the README.
+
+This function does not return until the pipeline has either finished or
+needs something from the caller, such as the request body. When the pipeline
+only looks at the headers, every command it produces, including the final
+"DONE," is ready to be returned by "GoPollRequest" without blocking as soon
+as this function returns. If the handler does not have GO_CAP_REQUEST_BODY
+or GO_CAP_SUBREQUESTS, then the pipeline runs on the calling thread.
+Otherwise it keeps running in the background. Either way, the caller MUST
+call "GoPollRequest" in order to get updates on the status of the request,
+and MUST call "GoFreeRequest" after the request is done.
 */
 //export GoBeginRequest
 func GoBeginRequest(id uint32, rawHeaders *C.char) {
 	beginRequest(id, C.GoString(rawHeaders))
 }
 
+/*
+GoSetRequestScheme sets the scheme, such as "http" or "https," that the request
+arrived with. It must be called before "GoBeginRequest." The scheme is not
+part of most request lines, so without it the pipeline sees "http" in the
+request URL.
+*/
+//export GoSetRequestScheme
+func GoSetRequestScheme(id uint32, scheme *C.char) {
+	setRequestScheme(id, C.GoString(scheme))
+}
+
+/*
+GoSetRequestHTTPVersion sets the major version of HTTP, either 2 or 3, for a
+request that starts with pseudo-headers, which do not include the version.
+Like "GoSetRequestScheme," it must be called before "GoBeginRequest." Without
+it, such a request is HTTP/2. It has no effect on a request that starts with
+a request line. If the version is not valid, then a string describing the
+error is returned, and the caller must free it using "free." Otherwise, NULL
+is returned.
+*/
+//export GoSetRequestHTTPVersion
+func GoSetRequestHTTPVersion(id, major uint32) *C.char {
+	err := setRequestHTTPVersion(id, int(major))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetRequestConnectionInfo tells the pipeline about the connection that the
+request arrived on. Like "GoSetRequestScheme," it must be called before
+"GoBeginRequest." If the information could not be used, then a string
+describing the error is returned, and the caller must free it using "free."
+Otherwise, NULL is returned.
+
+The first parameter is the request ID. The next two are the client address
+and the local address of the connection, each in "ip:port" form, and either
+may be NULL. An IPv6 address may have a zone, as in "[fe80::1%eth0]:443," and
+a Unix domain socket is "unix:" followed by its path. The client address
+becomes "RemoteAddr" in the request, and the local address is stored in the
+request context using "http.LocalAddrContextKey."
+
+The rest of the parameters describe TLS. If "tlsVersion" is zero, then the
+connection does not use TLS, and the rest are ignored. Otherwise, it and
+"cipherSuite" are the numbers from the TLS spec, "serverName" is the SNI
+server name, and "peerCerts" is the PEM-encoded certificate chain presented
+by the client, leaf first, or NULL. If "verified" is non-zero, then the
+caller has verified the client's chain, and the pipeline will see it in
+"VerifiedChains." Together these fill in the "TLS" field of the request, and
+make "https" the default scheme.
+*/
+//export GoSetRequestConnectionInfo
+func GoSetRequestConnectionInfo(
+	id uint32, remoteAddr, localAddr *C.char,
+	tlsVersion, cipherSuite uint32, serverName, peerCerts *C.char,
+	verified int32) *C.char {
+
+	conn, err := newConnectionInfo(
+		C.GoString(remoteAddr), C.GoString(localAddr),
+		uint16(tlsVersion), uint16(cipherSuite),
+		C.GoString(serverName), C.GoString(peerCerts),
+		verified != 0)
+	if err == nil {
+		err = setRequestConnectionInfo(id, conn)
+	}
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoSetRequestVariable sets a variable that the pipeline can read using the
+"weaver" package. Variables last until the request is freed, and are shared
+by the request and the response, so this may be called before
+"GoBeginRequest" or before "GoBeginResponse." When the pipeline sets a
+variable, the caller gets a WVAR command. If the variable could not be set,
+then a string describing the error is returned, and the caller must free it
+using "free." Otherwise, NULL is returned.
+*/
+//export GoSetRequestVariable
+func GoSetRequestVariable(id uint32, name, value *C.char) *C.char {
+	err := setRequestVariable(id, C.GoString(name), C.GoString(value))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
 /*
 GoPollRequest polls for updates from the running request. Each update is returned as
 a null-terminated string. The format of each command string is
@@ -253,13 +501,98 @@ The first parameter is the response ID as created by GoCreateResponse. The secon
 is the request ID that was previously used for the request side of this interaction.
 The third is the current HTTP status code of the response, while the last is a
 set of headers encoded in the same format used by the WHDR command: "name: value"
-lines separated by a single newline (not a CRLF as in HTTP).
+lines separated by a single newline (not a CRLF as in HTTP), with one line for
+each value of a header that has several. The headers may start with the
+status line from the upstream response, such as "HTTP/1.1 200 OK." In that
+case, the status code, protocol and reason phrase come from that line, and
+the status parameter is ignored. If the status line or any of the headers
+are not valid, then the response fails with an ERRR command.
 */
 //export GoBeginResponse
 func GoBeginResponse(responseID, requestID, status uint32, hdrs *C.char) {
 	beginResponse(responseID, requestID, status, C.GoString(hdrs))
 }
 
+/*
+GoBeginUpstreamError starts to handle a response that never arrived, because
+the caller could not get one from the upstream server. It is used instead of
+GoBeginResponse, and the caller polls for commands in the same way. The
+pipeline sees an empty response with no headers, and may replace it with an
+error of its own or ask for a retry using RTRY. If the pipeline changes
+nothing, the caller should send its usual error.
+
+The kind is one of these:
+
+GO_UPSTREAM_UNREACHABLE: The caller could not connect to the upstream
+server, or the connection failed before there was a response. The status is
+502.
+
+GO_UPSTREAM_TIMEOUT: The upstream server did not respond in time. The status
+is 504.
+
+GO_UPSTREAM_INVALID: The upstream server sent a response that the caller
+could not parse. The status is 502.
+
+The message describes the failure for the pipeline's logs. If the response
+could not be started, then a string describing the error is returned, and the
+caller must free it using "free." Otherwise, NULL is returned.
+*/
+//export GoBeginUpstreamError
+func GoBeginUpstreamError(responseID, requestID uint32, kind int32, message *C.char) *C.char {
+	failure := &weaver.UpstreamError{
+		Kind:    weaver.UpstreamErrorKind(kind),
+		Message: C.GoString(message),
+	}
+	err := beginUpstreamError(responseID, requestID, failure)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoCompleteTransaction tells the pipeline how a transaction went, once the
+caller has sent the whole response to the client. If the pipeline implements
+TransactionLogger from the "weaver" package, it runs in the background, so
+this returns right away and the caller may free the request and response as
+usual. The response ID is the last one that was used for the request, or
+zero if there was no response phase. The stats are:
+
+status: The status code that the client got.
+
+bytesReceived: The size of the request from the client, including headers.
+
+bytesSent: The size of the response to the client, including headers.
+
+upstreamTime: How long the upstream server took to respond, in microseconds,
+or -1 if the request never went there.
+
+requestTime: How long it took from the first byte of the request to the last
+byte of the response, in microseconds.
+
+If the request or response does not exist, or the transaction was already
+completed, then a string describing the error is returned, and the caller must
+free it using "free." Otherwise, NULL is returned.
+*/
+//export GoCompleteTransaction
+func GoCompleteTransaction(requestID, responseID uint32, stats *C.GoTransactionStats) *C.char {
+	ts := &weaver.TransactionStats{
+		Status:        int(stats.status),
+		BytesReceived: int64(stats.bytesReceived),
+		BytesSent:     int64(stats.bytesSent),
+		UpstreamTime:  -1,
+		RequestTime:   time.Duration(stats.requestTime) * time.Microsecond,
+	}
+	if stats.upstreamTime >= 0 {
+		ts.UpstreamTime = time.Duration(stats.upstreamTime) * time.Microsecond
+	}
+	err := completeTransaction(requestID, responseID, ts)
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
 // GoPollResponse returns response commands just like request commands.
 //export GoPollResponse
 func GoPollResponse(id uint32, block int32) *C.char {
@@ -270,6 +603,81 @@ func GoPollResponse(id uint32, block int32) *C.char {
 	return C.CString(cmd)
 }
 
+/*
+GoSendSubrequestResponse passes the response to a SUBR command back to the
+pipeline that is waiting for it. The first parameter is the subrequest ID
+from the command. The status and headers are in the same format as for
+GoBeginResponse, and the last two parameters are the whole response body,
+which is copied. If the subrequest ID is not known, or the headers are not
+valid, then an error message is returned, and the caller must free it.
+Otherwise, NULL is returned.
+*/
+//export GoSendSubrequestResponse
+func GoSendSubrequestResponse(
+	subID, status uint32, hdrs *C.char, body unsafe.Pointer, bodyLen uint32) *C.char {
+	err := sendSubrequestResponse(subID, status, C.GoString(hdrs), C.GoBytes(body, C.int(bodyLen)))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoFailSubrequest tells the pipeline that is waiting for a SUBR command that
+the caller could not make the request, for instance because the server could
+not be reached. The message is passed to the pipeline as an error. The result
+is the same as for GoSendSubrequestResponse.
+*/
+//export GoFailSubrequest
+func GoFailSubrequest(subID uint32, message *C.char) *C.char {
+	err := failSubrequest(subID, C.GoString(message))
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+/*
+GoPollRequestFrame polls for commands from a request whose handler has set
+the "framing" option to "binary." Instead of a string, each command is
+returned as a frame, which starts with a header of GO_FRAME_HEADER_SIZE
+bytes:
+
+  The four-letter command code, which is not NUL-terminated
+  The flags, as a 32-bit unsigned integer in network byte order
+  The length of the payload, as a 32-bit unsigned integer in network byte order
+
+The payload follows the header. It is the same as the text of the command
+after the command code, except that the payload of WBOD is the chunk ID as a
+32-bit integer in network byte order. The payload may contain NUL
+characters, and there is no NUL at the end. GO_FRAME_LAST is set in the
+flags of the last frame, which is either DONE or ERRR.
+
+The parameters are the same as for GoPollRequest, plus a pointer to where the
+total length of the frame, including the header, is stored. The result is
+NULL if there is no command, and otherwise the caller must call "free" on it.
+*/
+//export GoPollRequestFrame
+func GoPollRequestFrame(id uint32, block int32, frameLen *uint32) unsafe.Pointer {
+	return returnFrame(pollRequestFrame(id, block != 0), frameLen)
+}
+
+// GoPollResponseFrame returns response commands just like request commands.
+//export GoPollResponseFrame
+func GoPollResponseFrame(id uint32, block int32, frameLen *uint32) unsafe.Pointer {
+	return returnFrame(pollResponseFrame(id, block != 0), frameLen)
+}
+
+func returnFrame(frame []byte, frameLen *uint32) unsafe.Pointer {
+	if frame == nil {
+		*frameLen = 0
+		return nil
+	}
+	ptr, l := sliceToPtr(frame)
+	*frameLen = l
+	return ptr
+}
+
 // GoSendResponseBodyChunk sends a chunk for the response body just like for the
 // request body.
 //export GoSendResponseBodyChunk
@@ -278,6 +686,28 @@ func GoSendResponseBodyChunk(id uint32, l int32, data unsafe.Pointer, len uint32
 	sendResponseBodyChunk(id, last, buf)
 }
 
+/*
+GoSendRequestTrailers sends the last chunk of request data, just like
+GoSendRequestBodyChunk with the "last" flag set, along with the trailers that
+followed the body. The trailers are in the same format as the headers
+passed to GoBeginRequest. They are available to the pipeline in the
+"Trailer" field of the request by the time that it reads to the end of the body.
+The chunk may be empty.
+*/
+//export GoSendRequestTrailers
+func GoSendRequestTrailers(id uint32, data unsafe.Pointer, len uint32, trailers *C.char) {
+	buf := C.GoBytes(data, C.int(len))
+	sendRequestTrailers(id, buf, C.GoString(trailers))
+}
+
+// GoSendResponseTrailers sends the last chunk of the response body and the
+// trailers that followed it just like for the request body.
+//export GoSendResponseTrailers
+func GoSendResponseTrailers(id uint32, data unsafe.Pointer, len uint32, trailers *C.char) {
+	buf := C.GoBytes(data, C.int(len))
+	sendResponseTrailers(id, buf, C.GoString(trailers))
+}
+
 func copyPointer(l int32, data unsafe.Pointer, len uint32) ([]byte, bool) {
 	buf := C.GoBytes(data, C.int(len))
 	var last bool
@@ -293,3 +723,177 @@ func sliceToPtr(buf []byte) (unsafe.Pointer, uint32) {
 	copy((*[1 << 30]byte)(ptr)[:], buf)
 	return ptr, uint32(l)
 }
+
+func transactionStatsToC(stats *weaver.TransactionStats) *C.GoTransactionStats {
+	cs := &C.GoTransactionStats{
+		status:        C.uint(stats.Status),
+		bytesReceived: C.longlong(stats.BytesReceived),
+		bytesSent:     C.longlong(stats.BytesSent),
+		upstreamTime:  -1,
+		requestTime:   C.longlong(stats.RequestTime / time.Microsecond),
+	}
+	if stats.UpstreamTime >= 0 {
+		cs.upstreamTime = C.longlong(stats.UpstreamTime / time.Microsecond)
+	}
+	return cs
+}
+
+/*
+GoProcessRequestSync runs the whole request phase in one call, for hosts that
+do not want to poll for commands. The first parameter is the handler ID, the
+second is the request line and headers in the same format as GoBeginRequest,
+and the last two are the complete request body, which may be NULL. The body is
+copied, so the caller may free it as soon as this function returns.
+
+The result describes everything that the pipeline did:
+
+requestID: The ID of the request that was created. The caller must pass it to
+GoProcessResponseSync, or to GoBeginResponse, for the response phase, and
+must eventually call GoFreeRequest on it.
+
+error: If non-NULL, the request failed, and this is the error message. In that
+case, "status" is the HTTP status to send, as described for the ERRR command.
+
+switched: If non-zero, the pipeline generated the response itself. In that
+case "status," "headers," and "body" describe the response to send to the
+client and no target server should be called.
+
+uri: If non-NULL, the new URI, as described for the WURI command.
+
+method: If non-NULL, the new method, as described for the WMTH command.
+
+upstream: If non-NULL, the new upstream, as described for the WTGT command.
+
+redirect: If non-NULL, the location for an internal redirect, as described
+for the IRDR command.
+
+retry: If non-zero, the pipeline asked to retry the request, as described for
+the RTRY command. Then "upstream" is the new upstream, if there is one.
+
+logs: If non-NULL, the messages that the pipeline logged, each in the same
+format as the WLOG command, separated by single newlines.
+
+informational: If non-NULL, the informational responses that the pipeline
+wrote, such as 103 Early Hints, each in the same format as the WINF command
+and separated by empty lines. The caller should send them before the final
+response.
+
+headers: If non-NULL, the new set of headers, in the same format as WHDR.
+This is the complete set even if the "headerDeltas" option is set.
+
+trailers: If non-NULL, the new set of trailers, in the same format as WTRL.
+
+variables: If non-NULL, the variables that the pipeline set, in the same format
+as WHDR. A variable that was set more than once appears more than once, and
+the last value is the current one.
+
+bodyChanged: If non-zero, "body" and "bodyLen" contain the new body.
+
+The result must be freed using GoFreeSyncResult.
+*/
+//export GoProcessRequestSync
+func GoProcessRequestSync(handlerID, rawHeaders *C.char, body unsafe.Pointer, bodyLen uint32) *C.GoSyncResult {
+	result := processRequestSync(
+		C.GoString(handlerID), C.GoString(rawHeaders), C.GoBytes(body, C.int(bodyLen)))
+	return makeSyncResult(result)
+}
+
+/*
+GoProcessResponseSync runs the whole response phase in one call. The first
+parameter is the handler ID and the second is the request ID returned by
+GoProcessRequestSync. The status and headers are the same as for
+GoBeginResponse, and the last two parameters are the complete response body.
+
+The result is the same as for GoProcessRequestSync, except that if "switched"
+is zero, a non-zero "status" is the new status code of the response. In that
+case, "reason" is the new reason phrase if it is not the standard one for the
+status code, and NULL otherwise. It must be freed using GoFreeSyncResult.
+*/
+//export GoProcessResponseSync
+func GoProcessResponseSync(
+	handlerID *C.char, requestID, status uint32, hdrs *C.char,
+	body unsafe.Pointer, bodyLen uint32) *C.GoSyncResult {
+	result := processResponseSync(
+		C.GoString(handlerID), requestID, status, C.GoString(hdrs),
+		C.GoBytes(body, C.int(bodyLen)))
+	return makeSyncResult(result)
+}
+
+/*
+GoFreeSyncResult frees a result returned by GoProcessRequestSync or
+GoProcessResponseSync, along with everything that it points to.
+*/
+//export GoFreeSyncResult
+func GoFreeSyncResult(result *C.GoSyncResult) {
+	if result == nil {
+		return
+	}
+	C.free(unsafe.Pointer(result.error))
+	C.free(unsafe.Pointer(result.uri))
+	C.free(unsafe.Pointer(result.headers))
+	C.free(unsafe.Pointer(result.reason))
+	C.free(unsafe.Pointer(result.method))
+	C.free(unsafe.Pointer(result.upstream))
+	C.free(unsafe.Pointer(result.logs))
+	C.free(unsafe.Pointer(result.redirect))
+	C.free(unsafe.Pointer(result.informational))
+	C.free(unsafe.Pointer(result.trailers))
+	C.free(unsafe.Pointer(result.variables))
+	C.free(result.body)
+	C.free(unsafe.Pointer(result))
+}
+
+func makeSyncResult(r *syncResult) *C.GoSyncResult {
+	cr := (*C.GoSyncResult)(C.calloc(1, C.size_t(unsafe.Sizeof(C.GoSyncResult{}))))
+	cr.requestID = C.uint(r.requestID)
+	cr.status = C.uint(r.status)
+	if r.err != "" {
+		cr.error = C.CString(r.err)
+	}
+	if r.switched {
+		cr.switched = 1
+	}
+	if r.uri != "" {
+		cr.uri = C.CString(r.uri)
+	}
+	if r.headersSet {
+		cr.headers = C.CString(r.headers)
+	}
+	if r.trailersSet {
+		cr.trailers = C.CString(r.trailers)
+	}
+	if r.reason != "" {
+		cr.reason = C.CString(r.reason)
+	}
+	if r.method != "" {
+		cr.method = C.CString(r.method)
+	}
+	if r.upstream != "" {
+		cr.upstream = C.CString(r.upstream)
+	}
+	if r.redirect != "" {
+		cr.redirect = C.CString(r.redirect)
+	}
+	if r.retry {
+		cr.retry = 1
+	}
+	if len(r.logs) > 0 {
+		cr.logs = C.CString(strings.Join(r.logs, "\n"))
+	}
+	if len(r.variables) > 0 {
+		cr.variables = C.CString(strings.Join(r.variables, "\n") + "\n")
+	}
+	if len(r.informational) > 0 {
+		// Each one ends with a newline already.
+		cr.informational = C.CString(strings.Join(r.informational, "\n"))
+	}
+	if r.bodyChanged {
+		cr.bodyChanged = 1
+		if len(r.body) > 0 {
+			ptr, len := sliceToPtr(r.body)
+			cr.body = ptr
+			cr.bodyLen = C.uint(len)
+		}
+	}
+	return cr
+}
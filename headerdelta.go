@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+/*
+ * Tell the caller about changes to a set of headers. Callers that have
+ * asked for header deltas get one HADD, HSET or HDEL command for each
+ * change. Everyone else gets a single WHDR with the complete set, in the
+ * order in which the original headers were parsed. If the output policy
+ * rejects the new headers, then nothing is sent.
+ */
+func sendHeaderChanges(h commandHandler, deltas bool, policy outputPolicy,
+	fields headerList, orig, cur http.Header) error {
+	if reflect.DeepEqual(orig, cur) {
+		return nil
+	}
+	cur, err := policy.cleanHeaders(cur)
+	if err != nil {
+		return err
+	}
+	if !deltas {
+		h.SendCommand(command{
+			id:  WHDR,
+			msg: serializeHeadersInOrder(fields, orig, cur),
+		})
+		return nil
+	}
+	for _, cmd := range diffHeaders(fields, orig, cur) {
+		h.SendCommand(cmd)
+	}
+	return nil
+}
+
+/*
+ * Work out the list of changes that turns "orig" into "cur." If the pipeline
+ * only appended values, then we just add them. Otherwise, the first new value
+ * replaces all the old ones and the rest are added after it. Names are
+ * sorted so that the result is predictable. Headers that were in the
+ * original message keep the spelling that they had there.
+ */
+func diffHeaders(fields headerList, orig, cur http.Header) []command {
+	spellings := headerSpellings(fields)
+	names := sortedKeys(cur)
+	for name := range orig {
+		if _, present := cur[name]; !present {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var cmds []command
+	for _, key := range names {
+		oldVals := orig[key]
+		newVals := cur[key]
+		name, found := spellings[key]
+		if !found {
+			name = key
+		}
+
+		switch {
+		case len(newVals) == 0:
+			if len(oldVals) > 0 {
+				cmds = append(cmds, command{id: HDEL, msg: name})
+			}
+		case isPrefix(oldVals, newVals):
+			for _, v := range newVals[len(oldVals):] {
+				cmds = append(cmds, makeHeaderCommand(HADD, name, v))
+			}
+		default:
+			cmds = append(cmds, makeHeaderCommand(HSET, name, newVals[0]))
+			for _, v := range newVals[1:] {
+				cmds = append(cmds, makeHeaderCommand(HADD, name, v))
+			}
+		}
+	}
+	return cmds
+}
+
+func makeHeaderCommand(id CommandID, name, value string) command {
+	buf := &bytes.Buffer{}
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	writeHeaderValue(buf, value)
+	return command{
+		id:  id,
+		msg: buf.String(),
+	}
+}
+
+func isPrefix(prefix, vals []string) bool {
+	return len(prefix) <= len(vals) && stringsEqual(prefix, vals[:len(prefix)])
+}
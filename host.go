@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/30x/libgozerian/weaver"
+)
+
+/*
+ * This is the weaver.Host that pipelines see in the context of a request.
+ * Variables, logging and redirects work for the whole transaction, but the
+ * upstream only makes sense while the request is running, and retries only
+ * while the response is running.
+ */
+type requestHost struct {
+	*variables
+	req *request
+}
+
+var errRequestSent = errors.New("The request has already been sent")
+var errNotResponse = errors.New("Only a response can be retried")
+var errResponseSent = errors.New("The response has already been sent")
+
+/*
+ * The upstream is sent to the caller along with the other changes to the
+ * request, so it may only be set before that.
+ */
+func (h *requestHost) SetUpstream(target string) error {
+	if h.req.flushed {
+		return errRequestSent
+	}
+	upstream, err := parseUpstream(target)
+	if err != nil {
+		return err
+	}
+	h.req.upstream = upstream
+	return nil
+}
+
+/*
+ * Log messages go to whichever phase of the transaction is running, just
+ * like variables.
+ */
+func (h *requestHost) Log(level weaver.Level, text string) {
+	if !logEnabled(level) {
+		return
+	}
+	h.currentHandler().SendCommand(makeLogCommand(level, h.req.msgID, text))
+}
+
+/*
+ * The redirect is sent when the running phase is done.
+ */
+func (h *requestHost) Redirect(location string) error {
+	if err := checkRedirectLocation(location); err != nil {
+		return err
+	}
+	return h.currentHandler().SetRedirect(location)
+}
+
+/*
+ * Retries are counted for the whole request, but asking more than once
+ * during the same response only counts once. Once the pipeline has started
+ * sending the response, it's too late.
+ */
+func (h *requestHost) Retry(target string) error {
+	resp, ok := h.currentHandler().(*response)
+	if !ok {
+		return errNotResponse
+	}
+	if resp.written || resp.readStarted {
+		return errResponseSent
+	}
+	if target != "" {
+		var err error
+		target, err = parseUpstream(target)
+		if err != nil {
+			return err
+		}
+	}
+	if !resp.retrying {
+		if h.req.retries >= h.req.options.maxRetries {
+			return fmt.Errorf("Request has reached its limit of %d retries", h.req.options.maxRetries)
+		}
+		h.req.retries++
+		resp.retrying = true
+	}
+	resp.retryTarget = target
+	return nil
+}
+
+/*
+ * Only a response can have failed to arrive.
+ */
+func (h *requestHost) UpstreamFailure() *weaver.UpstreamError {
+	resp, ok := h.currentHandler().(*response)
+	if !ok {
+		return nil
+	}
+	return resp.failure
+}
+
+/*
+ * A location is either the name of a location that the caller knows about,
+ * starting with "@," or a path and optional query.
+ */
+func checkRedirectLocation(location string) error {
+	switch {
+	case strings.HasPrefix(location, "@") && len(location) > 1 &&
+		tokenLength(location[1:]) == len(location)-1:
+		return nil
+	case strings.HasPrefix(location, "/") && allValid(location, isURIChar):
+		return nil
+	default:
+		return fmt.Errorf("Invalid redirect location: \"%s\"", location)
+	}
+}
+
+/*
+ * An upstream is either a scheme, host and optional port, such as
+ * "https://example.com:8443," or the name of a group of upstream servers
+ * that the caller knows about, which must be a token.
+ */
+func parseUpstream(target string) (string, error) {
+	if !strings.Contains(target, "://") {
+		if target == "" || tokenLength(target) != len(target) {
+			return "", fmt.Errorf("Invalid upstream: \"%s\"", target)
+		}
+		return target, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") ||
+		u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Invalid upstream: \"%s\"", target)
+	}
+	if !allValid(u.Host, isURIChar) {
+		return "", fmt.Errorf("Invalid upstream: \"%s\"", target)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
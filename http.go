@@ -2,187 +2,771 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 const (
-	// HTTP grammar regexps borrowed from Trireme source
-	ctl       = "\\x00-\\x1f\\x7f"
-	digits    = "[0-9]"
-	lws       = "[ \\t]"
-	notCtl    = "[^" + ctl + "]"
-	separator = "\\(\\)<>@,;:\"/\\[\\]?+{} \t\\\\"
-	// Huh? Texts =       "[[ \t][^" + Ctl + "]]"
-	texts  = "[^" + ctl + "]"
-	tokens = "[^" + separator + ctl + "]"
-
-	headerLine  = "^(" + tokens + "+):" + lws + "*(" + notCtl + "*)" + lws + "*$"
-	requestLine = "^(" + tokens + "+) (" + texts + "+) HTTP/(" + digits + ").(" + digits + ")" + lws + "*$"
+	// HTTP grammar, as used by the header parser below.
+	separators  = "()<>@,;:\"/[]?+{} \t\\"
+	httpVersion = "HTTP/"
+	// " HTTP/x.y" at the end of a request line
+	versionSuffixLen = len(httpVersion) + 4
 )
 
-var requestLineRe = regexp.MustCompile(requestLine)
-var headerLineRe = regexp.MustCompile(headerLine)
+/*
+ * Lookup tables for the character classes in the HTTP grammar. "Text" is
+ * anything but a control character, and a "token" is text that also is not
+ * a separator. Bytes outside ASCII are allowed in both.
+ */
+var textChars [256]bool
+var tokenChars [256]bool
+
+func init() {
+	for c := 0; c < 256; c++ {
+		isCtl := c < 0x20 || c == 0x7f
+		textChars[c] = !isCtl
+		tokenChars[c] = !isCtl && strings.IndexByte(separators, byte(c)) < 0
+	}
+}
+
+/*
+ * A header exactly as it appeared in a message, before its name was
+ * canonicalized and it was put into an http.Header.
+ */
+type headerField struct {
+	name  string
+	value string
+}
 
+type headerList []headerField
+
+/*
+ * Parse the request line, if any, and headers of an HTTP request. Lines are
+ * separated by CRLF pairs. This walks the string once without splitting it,
+ * and every value in the result is a substring of the original. The header
+ * values all share one slice, so that there are only a handful of
+ * allocations no matter how many headers there are.
+ */
 func parseHTTPHeaders(rawHeaders string, hasRequestLine bool) (*http.Request, error) {
+	req, _, err := parseHTTPHeaderList(rawHeaders, hasRequestLine, 0)
+	return req, err
+}
+
+/*
+ * Parse the headers like "parseHTTPHeaders," and also return them in their
+ * original order and spelling. If "maxHeaders" is not zero, then parsing
+ * stops as soon as there are more headers than that.
+ */
+func parseHTTPHeaderList(rawHeaders string, hasRequestLine bool, maxHeaders int) (*http.Request, headerList, error) {
+	lines := strings.Count(rawHeaders, "\r\n") + 1
+	if maxHeaders > 0 && lines > maxHeaders+2 {
+		// There's no point in making room for headers that we will reject.
+		lines = maxHeaders + 2
+	}
 	req := http.Request{
-		Header: make(map[string][]string),
+		Header: make(map[string][]string, lines),
 	}
+	fields := make(headerList, 0, lines)
+	values := make([]string, 0, lines)
 
-	lines := strings.Split(rawHeaders, "\r\n")
+	rest := rawHeaders
+	first := true
+	var pseudo *pseudoHeaders
+	for {
+		line := rest
+		end := strings.Index(rest, "\r\n")
+		if end >= 0 {
+			line = rest[:end]
+			rest = rest[end+2:]
+		}
 
-	for i, line := range lines {
-		if hasRequestLine && (i == 0) {
-			err := parseRequestLine(line, &req)
-			if err != nil {
-				return nil, err
+		var err error
+		switch {
+		case hasRequestLine && first && isPseudoHeaderLine(line):
+			pseudo = &pseudoHeaders{}
+			err = pseudo.parseLine(line)
+		case pseudo != nil && isPseudoHeaderLine(line):
+			// Pseudo-headers must all come before the regular headers.
+			if len(fields) > 0 {
+				err = fmt.Errorf("HTTP pseudo-header after regular headers: \"%s\"", line)
+			} else {
+				err = pseudo.parseLine(line)
 			}
-		} else {
-			err := parseHeaderLine(line, &req)
-			if err != nil {
-				return nil, err
+		case hasRequestLine && first:
+			err = parseRequestLine(line, &req)
+		case maxHeaders > 0 && len(fields) >= maxHeaders && line != "":
+			err = &httpError{
+				status: http.StatusRequestHeaderFieldsTooLarge,
+				err:    fmt.Errorf("Request has more than %d headers", maxHeaders),
+			}
+		default:
+			err = parseHeaderLine(line, &req, &fields, &values)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if end < 0 {
+			break
+		}
+		first = false
+	}
+
+	if pseudo != nil {
+		err := pseudo.apply(&req)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if req.URL != nil && req.URL.Host != "" {
+		// The host in the target wins over the Host header (RFC 7230, 5.4).
+		req.Host = req.URL.Host
+	}
+	err := setRequestFraming(&req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &req, fields, nil
+}
+
+/*
+ * Work out how the request body is framed, following RFC 7230, section 3.3.3.
+ * A request that could be framed in more than one way is rejected, because
+ * a server behind us might choose differently, which is how request
+ * smuggling works.
+ */
+func setRequestFraming(req *http.Request) error {
+	if len(req.Header["Content-Length"]) > 1 {
+		return errors.New("Duplicate Content-Length headers")
+	}
+
+	encodings := transferEncodings(req.Header)
+	if len(req.Header["Transfer-Encoding"]) > 0 {
+		if len(req.Header["Content-Length"]) > 0 {
+			return errors.New("Request has both Transfer-Encoding and Content-Length")
+		}
+		// "chunked" must be the last encoding, and may only appear once.
+		last := len(encodings) - 1
+		if last < 0 || encodings[last] != "chunked" || hasToken(encodings[:last], "chunked") {
+			return fmt.Errorf("Invalid Transfer-Encoding: \"%s\"",
+				strings.Join(req.Header["Transfer-Encoding"], ", "))
+		}
+		req.TransferEncoding = encodings
+		req.ContentLength = -1
+		return nil
+	}
+
+	cl, err := contentLength(req.Header)
+	if err != nil {
+		return err
+	}
+	if cl > 0 {
+		req.ContentLength = cl
+	}
+	return nil
+}
+
+/*
+ * Return the transfer codings in the Transfer-Encoding header, in lower case.
+ */
+func transferEncodings(hdr http.Header) []string {
+	var encodings []string
+	for _, v := range hdr["Transfer-Encoding"] {
+		for _, te := range strings.Split(v, ",") {
+			te = strings.ToLower(strings.TrimSpace(te))
+			if te != "" {
+				encodings = append(encodings, te)
 			}
 		}
 	}
+	return encodings
+}
+
+/*
+ * Parse a request target in one of the forms from RFC 7230, section 5.3.
+ * CONNECT takes the "authority-form," which is just a host and port. Every
+ * other method takes the "origin-form," which is a path and query, the
+ * "absolute-form," which is a complete URI, or "*."
+ */
+func parseRequestTarget(method, target string) (*url.URL, error) {
+	if method == "CONNECT" {
+		u, err := url.Parse("http://" + target)
+		if err != nil || u.Port() == "" || u.User != nil ||
+			u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("Invalid CONNECT target: \"%s\"", target)
+		}
+		return &url.URL{Host: u.Host}, nil
+	}
+	return url.ParseRequestURI(target)
+}
+
+/*
+ * Fill in the scheme and host of a request URL that came from an origin-form
+ * target. The host comes from the Host header and the scheme comes from
+ * the caller, because it depends on how the connection was made.
+ */
+func completeRequestURL(req *http.Request, scheme string) {
+	if req.Method == "CONNECT" {
+		return
+	}
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = scheme
+	}
+	if req.URL.Host == "" {
+		req.URL.Host = req.Host
+	}
+}
 
-	return &req, nil
+/*
+ * Work out what to send in a WURI command when the pipeline changed the
+ * request URL. Unless the pipeline changed the scheme or host, this is just
+ * the path and query, like an origin-form target. Otherwise, it is the
+ * whole URL, or just the authority for a CONNECT request.
+ */
+func rewrittenTarget(method string, orig, cur *url.URL) string {
+	if method == "CONNECT" {
+		return cur.Host
+	}
+	if cur.Host == "" || (cur.Scheme == orig.Scheme && cur.Host == orig.Host) {
+		return cur.RequestURI()
+	}
+	return cur.String()
 }
 
-func parseHTTPResponse(status uint32, rawHeaders string) (*http.Response, error) {
+/*
+ * Parse the status and headers of a response that were passed to
+ * GoBeginResponse. The headers use the format from "serializeHeaders," but
+ * they may start with an HTTP status line, such as "HTTP/1.1 200 OK." Then
+ * the protocol, status code and reason phrase come from that line instead.
+ * Unlike WHDR, these headers came from an upstream server, so any header
+ * line that isn't valid is an error. Values are only unescaped if "unescape"
+ * is set, because most callers pass them on exactly as the server sent them.
+ */
+func parseHTTPResponse(status uint32, rawHeaders string, unescape bool) (*http.Response, headerList, error) {
 	resp := http.Response{
 		Header:     make(map[string][]string),
 		StatusCode: int(status),
-		Status:     http.StatusText(int(status)),
-		// Faking this for now
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 	}
+	reason := http.StatusText(int(status))
 
-	parseHeaders(resp.Header, rawHeaders)
-
-	clHeader := resp.Header.Get("Content-Length")
-	if clHeader != "" {
-		cl, err := strconv.ParseInt(clHeader, 10, 64)
+	rest := rawHeaders
+	if strings.HasPrefix(rest, httpVersion) {
+		line := rest
+		end := strings.IndexByte(rest, '\n')
+		if end >= 0 {
+			line = rest[:end]
+			rest = rest[end+1:]
+		} else {
+			rest = ""
+		}
+		var err error
+		reason, err = parseStatusLine(strings.TrimSuffix(line, "\r"), &resp)
 		if err != nil {
-			resp.ContentLength = cl
+			return nil, nil, err
+		}
+	}
+	resp.Status = strconv.Itoa(resp.StatusCode)
+	if reason != "" {
+		resp.Status += " " + reason
+	}
+
+	fields, err := parseHeaderFields(resp.Header, rest, true, unescape)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = setResponseFraming(&resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &resp, fields, nil
+}
+
+/*
+ * Parse a status line like "HTTP/1.1 404 Not Found" and return the reason
+ * phrase, which may be empty. The version may also be a single digit,
+ * as in "HTTP/2 200."
+ */
+func parseStatusLine(line string, resp *http.Response) (string, error) {
+	invalid := fmt.Errorf("Invalid HTTP status line: \"%s\"", line)
+	v := line[len(httpVersion):]
+	var rest string
+	switch {
+	case len(v) >= 3 && isDigit(v[0]) && v[1] == '.' && isDigit(v[2]):
+		resp.ProtoMajor = int(v[0] - '0')
+		resp.ProtoMinor = int(v[2] - '0')
+		rest = v[3:]
+	case len(v) >= 1 && isDigit(v[0]):
+		resp.ProtoMajor = int(v[0] - '0')
+		resp.ProtoMinor = 0
+		rest = v[1:]
+	default:
+		return "", invalid
+	}
+
+	if len(rest) < 4 || rest[0] != ' ' ||
+		!isDigit(rest[1]) || !isDigit(rest[2]) || !isDigit(rest[3]) || rest[1] == '0' {
+		return "", invalid
+	}
+	code := int(rest[1]-'0')*100 + int(rest[2]-'0')*10 + int(rest[3]-'0')
+
+	reason := rest[4:]
+	if reason != "" {
+		if reason[0] != ' ' {
+			return "", invalid
+		}
+		reason = strings.TrimRight(reason[1:], " \t")
+		if !isText(strings.Replace(reason, "\t", " ", -1)) {
+			return "", invalid
 		}
 	}
 
-	closeHeader := resp.Header.Get("Connection")
-	if closeHeader == "close" {
-		resp.Close = true
+	resp.Proto = fmt.Sprintf("HTTP/%d.%d", resp.ProtoMajor, resp.ProtoMinor)
+	resp.StatusCode = code
+	return reason, nil
+}
+
+/*
+ * Fill in the fields of the response that describe how the body is framed,
+ * following RFC 7230, section 3.3.3. The headers stay in the map as well, so
+ * that they are passed along if the pipeline changes any headers.
+ */
+func setResponseFraming(resp *http.Response) error {
+	resp.TransferEncoding = transferEncodings(resp.Header)
+
+	cl, err := contentLength(resp.Header)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !bodyAllowedForStatus(resp.StatusCode):
+		resp.ContentLength = 0
+	case len(resp.TransferEncoding) > 0:
+		// Transfer-Encoding overrides Content-Length.
+		resp.ContentLength = -1
+	default:
+		resp.ContentLength = cl
 	}
 
-	return &resp, nil
+	resp.Close = hasToken(resp.Header["Connection"], "close") ||
+		(resp.ProtoMajor == 1 && resp.ProtoMinor == 0 &&
+			!hasToken(resp.Header["Connection"], "keep-alive"))
+	return nil
+}
+
+/*
+ * Return the value of the Content-Length header, or -1 if there is none.
+ * If the header appears more than once, all the values must be the same.
+ */
+func contentLength(hdr http.Header) (int64, error) {
+	vals := hdr["Content-Length"]
+	if len(vals) == 0 {
+		return -1, nil
+	}
+	for _, v := range vals[1:] {
+		if v != vals[0] {
+			return 0, fmt.Errorf("Conflicting Content-Length headers: \"%s\" and \"%s\"", vals[0], v)
+		}
+	}
+	cl, err := strconv.ParseInt(vals[0], 10, 64)
+	if err != nil || cl < 0 || !isDigit(vals[0][0]) {
+		return 0, fmt.Errorf("Invalid Content-Length header: \"%s\"", vals[0])
+	}
+	return cl, nil
 }
 
-//serialize the headersMap back to a string
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status < 200:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	default:
+		return true
+	}
+}
+
+/*
+ * Check for a token in a comma-separated list header such as Connection.
+ */
+func hasToken(vals []string, token string) bool {
+	for _, v := range vals {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * Return the reason phrase of a response. If the pipeline changed the
+ * status code without changing "Status," then the reason phrase from
+ * upstream no longer applies, so use the standard one.
+ */
+func statusReason(resp *http.Response) string {
+	prefix := strconv.Itoa(resp.StatusCode) + " "
+	if strings.HasPrefix(resp.Status, prefix) {
+		return resp.Status[len(prefix):]
+	}
+	return http.StatusText(resp.StatusCode)
+}
+
+/*
+ * Format the status for WSTA. The reason phrase is only included if it is
+ * not the standard one for the status code.
+ */
+func formatStatus(code int, reason string) string {
+	if reason == http.StatusText(code) {
+		return strconv.Itoa(code)
+	}
+	return strconv.Itoa(code) + " " + reason
+}
+
+/*
+ * Parse the status in a WSTA command. The reason phrase is empty unless
+ * the command included one.
+ */
+func parseStatus(msg string) (int, string) {
+	codeStr := msg
+	reason := ""
+	sp := strings.IndexByte(msg, ' ')
+	if sp >= 0 {
+		codeStr = msg[:sp]
+		reason = msg[sp+1:]
+	}
+	code, _ := strconv.Atoi(codeStr)
+	return code, reason
+}
+
+/*
+ * Serialize headers in the format used by WHDR and GoBeginResponse. Each
+ * value goes on its own line, so a header with several values appears
+ * several times. Newlines and backslashes within values are escaped, so
+ * that any http.Header can be reproduced exactly by "parseHeaders."
+ */
 func serializeHeaders(headerMap http.Header) string {
 	var buffer bytes.Buffer
+	for _, key := range sortedKeys(headerMap) {
+		for _, value := range headerMap[key] {
+			writeHeaderLine(&buffer, key, value)
+		}
+	}
+	return buffer.String()
+}
+
+/*
+ * Serialize "cur" like "serializeHeaders," but keep the order and spelling
+ * of "fields," which are the headers that were originally parsed into "orig."
+ * Headers that the pipeline did not change stay where they were. The rest go
+ * at the end, using their original spelling if they had one.
+ */
+func serializeHeadersInOrder(fields headerList, orig, cur http.Header) string {
+	var buffer bytes.Buffer
+	spellings := headerSpellings(fields)
+	for _, f := range fields {
+		key := http.CanonicalHeaderKey(f.name)
+		if stringsEqual(orig[key], cur[key]) {
+			writeHeaderLine(&buffer, f.name, f.value)
+		}
+	}
+
+	for _, key := range sortedKeys(cur) {
+		name, found := spellings[key]
+		if !found {
+			name = key
+		} else if stringsEqual(orig[key], cur[key]) {
+			continue
+		}
+		for _, value := range cur[key] {
+			writeHeaderLine(&buffer, name, value)
+		}
+	}
+	return buffer.String()
+}
+
+/*
+ * Map each canonical header name to the way that it was first spelled in the
+ * original message.
+ */
+func headerSpellings(fields headerList) map[string]string {
+	spellings := make(map[string]string, len(fields))
+	for _, f := range fields {
+		key := http.CanonicalHeaderKey(f.name)
+		if _, found := spellings[key]; !found {
+			spellings[key] = f.name
+		}
+	}
+	return spellings
+}
+
+func writeHeaderLine(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	writeHeaderValue(buf, value)
+	buf.WriteString("\n")
+}
+
+func sortedKeys(headerMap http.Header) []string {
+	keys := make([]string, 0, len(headerMap))
 	for key := range headerMap {
-		values := headerMap[key]
-		var valuesBuffer bytes.Buffer
-		for i := 0; i < len(values); i++ {
-			if values[i] != "" {
-				if i > 0 {
-					valuesBuffer.WriteString(",")
-				}
-				valuesBuffer.WriteString(values[i])
-			}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
-		val := valuesBuffer.String()
-		buffer.WriteString(key)
-		buffer.WriteString(": ")
-		buffer.WriteString(val)
-		buffer.WriteString("\n")
 	}
-	serializedHeaders := buffer.String()
+	return true
+}
 
-	return serializedHeaders
+/*
+ * Escape a header value so that it fits on one line. Tabs and a leading
+ * space are escaped too, because white space after the colon is not part
+ * of the value.
+ */
+func writeHeaderValue(buf *bytes.Buffer, value string) {
+	if strings.IndexAny(value, "\\\r\n\t") < 0 && !strings.HasPrefix(value, " ") {
+		buf.WriteString(value)
+		return
+	}
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\t':
+			buf.WriteString("\\t")
+		case ' ':
+			if i == 0 {
+				buf.WriteString("\\s")
+			} else {
+				buf.WriteByte(' ')
+			}
+		default:
+			buf.WriteByte(value[i])
+		}
+	}
 }
 
 /*
  * Parse the simplified header serialization format supported by
  * "serializeHeaders." This format is not the same as the HTTP standard.
+ * Values are added to whatever is already in the map, and are also returned
+ * in their original order and spelling. For the benefit of callers that use
+ * CRLF pairs anyway, a CR at the end of a line is ignored.
  */
-func parseHeaders(headerMap http.Header, rawHeaders string) {
-	headerValues := strings.Split(rawHeaders, "\n")
-	for _, header := range headerValues {
-		keyValue := strings.Split(header, ": ")
-		if len(keyValue) == 2 {
-			key := keyValue[0]
-			valueString := keyValue[1]
-			if valueString != "" {
-				values := strings.Split(valueString, ",")
-				if _, ok := headerMap[key]; !ok {
-					headerMap[key] = make([]string, len(values))
-				}
-				for i := 0; i < len(values); i++ {
-					headerMap[key][i] = values[i]
-				}
-			}
+func parseHeaders(headerMap http.Header, rawHeaders string) headerList {
+	fields, _ := parseHeaderFields(headerMap, rawHeaders, false, true)
+	return fields
+}
+
+/*
+ * Parse headers like "parseHeaders." If "strict" is set, then lines
+ * without a valid header name, or with control characters in the value,
+ * are errors. Otherwise, lines without a colon are skipped. Backslash
+ * escapes in values are only undone if "unescape" is set.
+ */
+func parseHeaderFields(
+	headerMap http.Header, rawHeaders string, strict, unescape bool) (headerList, error) {
+	var fields headerList
+	rest := rawHeaders
+	for rest != "" {
+		line := rest
+		end := strings.IndexByte(rest, '\n')
+		if end >= 0 {
+			line = rest[:end]
+			rest = rest[end+1:]
+		} else {
+			rest = ""
+		}
+		line = strings.TrimSuffix(line, "\r")
+
+		colon := strings.IndexByte(line, ':')
+		if strict && line != "" && (colon <= 0 || tokenLength(line) != colon ||
+			!isText(strings.Replace(line[colon+1:], "\t", " ", -1))) {
+			return nil, fmt.Errorf("Invalid HTTP header line: \"%s\"", line)
+		}
+		if colon <= 0 {
+			continue
+		}
+		name := line[:colon]
+		value := strings.TrimLeft(line[colon+1:], " \t")
+		if unescape {
+			value = unescapeHeaderValue(value)
 		}
+		headerMap.Add(name, value)
+		fields = append(fields, headerField{name: name, value: value})
+	}
+	return fields, nil
+}
 
+func unescapeHeaderValue(value string) string {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
 	}
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '\\' && i+1 < len(value) {
+			if u, ok := headerEscapes[value[i+1]]; ok {
+				c = u
+				i++
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+// Escape sequences in serialized header values. Anything else is left alone.
+var headerEscapes = map[byte]byte{
+	'\\': '\\',
+	'r':  '\r',
+	'n':  '\n',
+	't':  '\t',
+	's':  ' ',
 }
 
 func parseRequestLine(line string, req *http.Request) error {
-	matches := requestLineRe.FindStringSubmatch(line)
-	if matches == nil {
+	mlen := tokenLength(line)
+	if mlen == 0 || mlen == len(line) || line[mlen] != ' ' {
 		return fmt.Errorf("Invalid HTTP request line: \"%s\"", line)
 	}
 
-	url, err := url.ParseRequestURI(matches[2])
-	if err != nil {
-		return err
+	// The URI may contain spaces, so work backwards from the version.
+	target := strings.TrimRight(line[mlen+1:], " \t")
+	vpos := len(target) - versionSuffixLen
+	if vpos < 1 || !isRequestVersion(target[vpos:]) || !isText(target[:vpos]) {
+		return fmt.Errorf("Invalid HTTP request line: \"%s\"", line)
 	}
+	uri := target[:vpos]
+	proto := target[vpos+1:]
 
-	major, err := strconv.Atoi(matches[3])
-	if err != nil {
-		return err
-	}
-	minor, err := strconv.Atoi(matches[4])
+	method := line[:mlen]
+	url, err := parseRequestTarget(method, uri)
 	if err != nil {
 		return err
 	}
 
 	req.URL = url
-	req.RequestURI = matches[2]
-	req.Method = matches[1]
-	req.ProtoMajor = major
-	req.ProtoMinor = minor
-	req.Proto = fmt.Sprintf("HTTP/%d.%d", major, minor)
+	req.RequestURI = uri
+	req.Method = method
+	req.ProtoMajor = int(proto[5] - '0')
+	req.ProtoMinor = int(proto[7] - '0')
+	req.Proto = proto
 	return nil
 }
 
-func parseHeaderLine(line string, req *http.Request) error {
+func parseHeaderLine(line string, req *http.Request, fields *headerList, values *[]string) error {
 	if "" == line {
 		return nil
 	}
-	matches := headerLineRe.FindStringSubmatch(line)
-	if matches == nil {
+	if isLWS(line[0]) && len(*fields) > 0 {
+		// RFC 7230 lets us either reject these or unfold them.
+		return fmt.Errorf("Obsolete line folding is not allowed: \"%s\"", line)
+	}
+	nlen := tokenLength(line)
+	if nlen == 0 || nlen == len(line) || line[nlen] != ':' {
+		return fmt.Errorf("Invalid HTTP header line: \"%s\"", line)
+	}
+	val, ok := headerValue(line[nlen+1:])
+	if !ok {
 		return fmt.Errorf("Invalid HTTP header line: \"%s\"", line)
 	}
 
-	key := http.CanonicalHeaderKey(matches[1])
-	val := matches[2]
-	req.Header.Add(key, val)
+	key := http.CanonicalHeaderKey(line[:nlen])
+	if vals := req.Header[key]; vals != nil {
+		req.Header[key] = append(vals, val)
+	} else {
+		// The capacity is limited so that another value for the same header
+		// doesn't overwrite the next one in the shared slice.
+		n := len(*values)
+		*values = append(*values, val)
+		req.Header[key] = (*values)[n : n+1 : n+1]
+	}
+	*fields = append(*fields, headerField{name: line[:nlen], value: val})
 
-	switch key {
-	case "Host":
+	if key == "Host" {
 		req.Host = val
-	case "Content-Length":
-		len, err := strconv.ParseInt(val, 10, 64)
-		if err != nil {
-			return err
+	}
+	return nil
+}
+
+/*
+ * Return the value part of a header line, which is everything after the
+ * colon without leading white space or trailing tabs. Trailing spaces are
+ * kept, as they were by the regular expression that this replaced. The value
+ * may contain spaces but no control characters, including tabs.
+ */
+func headerValue(s string) (string, bool) {
+	start := 0
+	for start < len(s) && isLWS(s[start]) {
+		start++
+	}
+	end := start
+	for end < len(s) && textChars[s[end]] {
+		end++
+	}
+	for i := end; i < len(s); i++ {
+		if !isLWS(s[i]) {
+			return "", false
 		}
-		req.ContentLength = len
 	}
+	return s[start:end], true
+}
 
-	return nil
+/*
+ * Check for " HTTP/x.y" where x and y are single digits.
+ */
+func isRequestVersion(s string) bool {
+	return len(s) == versionSuffixLen &&
+		s[0] == ' ' &&
+		s[1:6] == httpVersion &&
+		isDigit(s[6]) && s[7] == '.' && isDigit(s[8])
+}
+
+func tokenLength(s string) int {
+	i := 0
+	for i < len(s) && tokenChars[s[i]] {
+		i++
+	}
+	return i
+}
+
+func isText(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !textChars[s[i]] {
+			return false
+		}
+	}
+	return true
+}
+
+func isLWS(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
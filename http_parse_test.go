@@ -1,6 +1,10 @@
 package main
 
 import (
+	"net/http"
+	"net/url"
+	"strings"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -77,3 +81,482 @@ var _ = Describe("HTTP Parsing", func() {
 		Expect(err).ShouldNot(Succeed())
 	})
 })
+
+var _ = Describe("Request Framing", func() {
+	It("Chunked", func() {
+		req, err := parseHTTPHeaders("POST / HTTP/1.1\r\n"+
+			"Transfer-Encoding: gzip\r\nTransfer-Encoding: Chunked\r\n\r\n", true)
+		Expect(err).Should(Succeed())
+		Expect(req.TransferEncoding).Should(Equal([]string{"gzip", "chunked"}))
+		Expect(req.ContentLength).Should(BeEquivalentTo(-1))
+	})
+
+	It("Smuggling", func() {
+		for _, hdrs := range []string{
+			"Content-Length: 10\r\nTransfer-Encoding: chunked\r\n",
+			"Transfer-Encoding: chunked\r\nContent-Length: 10\r\n",
+			"Content-Length: 10\r\nContent-Length: 10\r\n",
+			"Content-Length: 10\r\nContent-Length: 20\r\n",
+			"Content-Length: 10, 20\r\n",
+			"Content-Length: -10\r\n",
+			"Content-Length: abc\r\n",
+			"Transfer-Encoding: gzip\r\n",
+			"Transfer-Encoding: chunked, gzip\r\n",
+			"Transfer-Encoding: chunked, chunked\r\n",
+			"Transfer-Encoding: \r\n",
+		} {
+			_, err := parseHTTPHeaders("POST / HTTP/1.1\r\n"+hdrs+"\r\n", true)
+			Expect(err).ShouldNot(Succeed(), hdrs)
+		}
+	})
+
+	It("Obsolete line folding", func() {
+		_, err := parseHTTPHeaders("GET / HTTP/1.1\r\nX-Foo: one\r\n two\r\n\r\n", true)
+		Expect(err).ShouldNot(Succeed())
+		Expect(err.Error()).Should(ContainSubstring("Obsolete line folding"))
+		_, err = parseHTTPHeaders("GET / HTTP/1.1\r\nX-Foo: one\r\n\ttwo\r\n\r\n", true)
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Header count limit", func() {
+		raw := "GET / HTTP/1.1\r\nHost: a\r\nX-One: 1\r\n\r\n"
+		_, fields, err := parseHTTPHeaderList(raw, true, 2)
+		Expect(err).Should(Succeed())
+		Expect(fields).Should(HaveLen(2))
+
+		// Parsing stops at the first header too many, before the invalid one.
+		raw = "GET / HTTP/1.1\r\nHost: a\r\nX-One: 1\r\nX-Two: 2\r\nbad line\r\n\r\n"
+		_, _, err = parseHTTPHeaderList(raw, true, 2)
+		Expect(err).ShouldNot(Succeed())
+		Expect(errorStatus(err)).Should(Equal(http.StatusRequestHeaderFieldsTooLarge))
+		Expect(err.Error()).Should(Equal("Request has more than 2 headers"))
+	})
+})
+
+var _ = Describe("Request Target Parsing", func() {
+	It("Origin Form", func() {
+		req, err := parseHTTPHeaders(CompleteRequestLength, true)
+		Expect(err).Should(Succeed())
+		Expect(req.URL.Host).Should(BeEmpty())
+		completeRequestURL(req, "https")
+		Expect(req.URL.String()).Should(Equal("https://mybox/foo/bar/baz"))
+	})
+
+	It("Absolute Form", func() {
+		req, err := parseHTTPHeaders("GET http://example.com:8080/foo?bar=baz HTTP/1.1\r\n"+
+			"Host: mybox\r\n\r\n", true)
+		Expect(err).Should(Succeed())
+		Expect(req.RequestURI).Should(Equal("http://example.com:8080/foo?bar=baz"))
+		Expect(req.URL.Scheme).Should(Equal("http"))
+		Expect(req.URL.Host).Should(Equal("example.com:8080"))
+		Expect(req.URL.Path).Should(Equal("/foo"))
+		Expect(req.Host).Should(Equal("example.com:8080"))
+		completeRequestURL(req, "https")
+		Expect(req.URL.Scheme).Should(Equal("http"))
+	})
+
+	It("Authority Form", func() {
+		req, err := parseHTTPHeaders("CONNECT example.com:443 HTTP/1.1\r\n"+
+			"Host: example.com:443\r\n\r\n", true)
+		Expect(err).Should(Succeed())
+		Expect(req.RequestURI).Should(Equal("example.com:443"))
+		Expect(req.URL.Host).Should(Equal("example.com:443"))
+		Expect(req.URL.Scheme).Should(BeEmpty())
+		Expect(req.URL.Path).Should(BeEmpty())
+		Expect(req.Host).Should(Equal("example.com:443"))
+
+		for _, bad := range []string{"/foo", "example.com:443/foo", "user@example.com:443", "*"} {
+			_, err = parseHTTPHeaders("CONNECT "+bad+" HTTP/1.1\r\n\r\n", true)
+			Expect(err).ShouldNot(Succeed(), bad)
+		}
+	})
+
+	It("Asterisk Form", func() {
+		req, err := parseHTTPHeaders("OPTIONS * HTTP/1.1\r\nHost: mybox\r\n\r\n", true)
+		Expect(err).Should(Succeed())
+		Expect(req.URL.Path).Should(Equal("*"))
+		Expect(req.URL.RequestURI()).Should(Equal("*"))
+	})
+
+	It("Rewritten Target", func() {
+		orig, _ := url.Parse("http://mybox/foo")
+		cur, _ := url.Parse("http://mybox/bar?baz=1")
+		Expect(rewrittenTarget("GET", orig, cur)).Should(Equal("/bar?baz=1"))
+		cur, _ = url.Parse("/bar")
+		Expect(rewrittenTarget("GET", orig, cur)).Should(Equal("/bar"))
+		cur, _ = url.Parse("https://mybox/foo")
+		Expect(rewrittenTarget("GET", orig, cur)).Should(Equal("https://mybox/foo"))
+		cur, _ = url.Parse("http://other:8080/foo")
+		Expect(rewrittenTarget("GET", orig, cur)).Should(Equal("http://other:8080/foo"))
+		Expect(rewrittenTarget("CONNECT", &url.URL{Host: "mybox:443"},
+			&url.URL{Host: "other:443"})).Should(Equal("other:443"))
+	})
+})
+
+var _ = Describe("Pseudo-Header Parsing", func() {
+	It("HTTP/2 Request", func() {
+		req, err := parseHTTPHeaders(":method: POST\r\n"+
+			":scheme: https\r\n"+
+			":authority: mybox:8443\r\n"+
+			":path: /foo/bar?baz=1\r\n"+
+			"content-length: 13\r\n"+
+			"te: trailers\r\n"+
+			"\r\n", true)
+		Expect(err).Should(Succeed())
+		Expect(req.Method).Should(Equal("POST"))
+		Expect(req.RequestURI).Should(Equal("/foo/bar?baz=1"))
+		Expect(req.URL.Scheme).Should(Equal("https"))
+		Expect(req.URL.Host).Should(Equal("mybox:8443"))
+		Expect(req.URL.Path).Should(Equal("/foo/bar"))
+		Expect(req.URL.RawQuery).Should(Equal("baz=1"))
+		Expect(req.Host).Should(Equal("mybox:8443"))
+		Expect(req.Proto).Should(Equal("HTTP/2.0"))
+		Expect(req.ProtoMajor).Should(Equal(2))
+		Expect(req.ProtoMinor).Should(Equal(0))
+		Expect(req.ContentLength).Should(BeEquivalentTo(13))
+		Expect(req.Header).ShouldNot(HaveKey(":method"))
+	})
+
+	It("HTTP/3 Request", func() {
+		req, err := parseHTTPHeaders(":method: GET\r\n:scheme: https\r\n"+
+			":path: /\r\nhost: mybox\r\n", true)
+		Expect(err).Should(Succeed())
+		setPseudoHeaderVersion(req, 3)
+		Expect(req.Proto).Should(Equal("HTTP/3.0"))
+		Expect(req.ProtoMajor).Should(Equal(3))
+		Expect(req.Host).Should(Equal("mybox"))
+		Expect(req.URL.Host).Should(BeEmpty())
+
+		req, err = parseHTTPHeaders("GET / HTTP/1.1\r\nhost: mybox\r\n", true)
+		Expect(err).Should(Succeed())
+		setPseudoHeaderVersion(req, 3)
+		Expect(req.Proto).Should(Equal("HTTP/1.1"))
+	})
+
+	It("CONNECT Request", func() {
+		req, err := parseHTTPHeaders(":method: CONNECT\r\n:authority: mybox:443\r\n", true)
+		Expect(err).Should(Succeed())
+		Expect(req.Method).Should(Equal("CONNECT"))
+		Expect(req.RequestURI).Should(Equal("mybox:443"))
+		Expect(req.URL.Host).Should(Equal("mybox:443"))
+		Expect(req.Host).Should(Equal("mybox:443"))
+	})
+
+	It("Invalid Requests", func() {
+		invalid := []string{
+			":method: GET\r\n:path: /\r\n",
+			":method: GET\r\n:scheme: https\r\n",
+			":scheme: https\r\n:path: /\r\n",
+			":method: GET\r\n:method: GET\r\n:scheme: https\r\n:path: /\r\n",
+			":method: GET\r\n:scheme: https\r\n:path: /\r\n:status: 200\r\n",
+			":method: GET\r\n:scheme: https\r\n:path: /\r\n:version: 3\r\n",
+			":method: GET\r\n:scheme: https\r\nhost: mybox\r\n:path: /\r\n",
+			":method: CONNECT\r\n:authority: mybox:443\r\n:path: /\r\n",
+			":method: CONNECT\r\n",
+			":method GET\r\n",
+			"GET / HTTP/1.1\r\n:method: GET\r\n",
+		}
+		for _, raw := range invalid {
+			_, err := parseHTTPHeaders(raw, true)
+			Expect(err).ShouldNot(Succeed(), raw)
+		}
+	})
+
+	It("Connection-specific headers", func() {
+		base := ":method: GET\r\n:scheme: https\r\n:path: /\r\n"
+		for _, hdr := range []string{
+			"connection: keep-alive", "keep-alive: 5", "proxy-connection: close",
+			"transfer-encoding: chunked", "upgrade: websocket", "te: gzip",
+		} {
+			_, err := parseHTTPHeaders(base+hdr+"\r\n", true)
+			Expect(err).ShouldNot(Succeed(), hdr)
+		}
+	})
+})
+
+var _ = Describe("Response Parsing", func() {
+	It("Headers only", func() {
+		resp, fields, err := parseHTTPResponse(201,
+			"Content-Length: 13\nConnection: keep-alive, Close\nX-Foo: bar\n", false)
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(201))
+		Expect(resp.Status).Should(Equal("201 Created"))
+		Expect(resp.Proto).Should(Equal("HTTP/1.1"))
+		Expect(resp.ContentLength).Should(BeEquivalentTo(13))
+		Expect(resp.TransferEncoding).Should(BeEmpty())
+		Expect(resp.Close).Should(BeTrue())
+		Expect(resp.Header.Get("X-Foo")).Should(Equal("bar"))
+		Expect(fields).Should(HaveLen(3))
+	})
+
+	It("Status line", func() {
+		resp, _, err := parseHTTPResponse(200,
+			"HTTP/1.0 404 Not Here\r\nTransfer-Encoding: gzip, Chunked\nContent-Length: 10\n", false)
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(404))
+		Expect(resp.Status).Should(Equal("404 Not Here"))
+		Expect(resp.Proto).Should(Equal("HTTP/1.0"))
+		Expect(resp.ProtoMajor).Should(Equal(1))
+		Expect(resp.ProtoMinor).Should(Equal(0))
+		Expect(resp.TransferEncoding).Should(Equal([]string{"gzip", "chunked"}))
+		Expect(resp.Header.Get("Transfer-Encoding")).Should(Equal("gzip, Chunked"))
+		Expect(resp.ContentLength).Should(BeEquivalentTo(-1))
+		Expect(resp.Close).Should(BeTrue())
+		Expect(statusReason(resp)).Should(Equal("Not Here"))
+	})
+
+	It("Short status lines", func() {
+		resp, _, err := parseHTTPResponse(0, "HTTP/2 204\n", false)
+		Expect(err).Should(Succeed())
+		Expect(resp.Proto).Should(Equal("HTTP/2.0"))
+		Expect(resp.StatusCode).Should(Equal(204))
+		Expect(resp.Status).Should(Equal("204"))
+		Expect(resp.ContentLength).Should(BeZero())
+		Expect(resp.Close).Should(BeFalse())
+
+		resp, _, err = parseHTTPResponse(0, "HTTP/1.1 200 ", false)
+		Expect(err).Should(Succeed())
+		Expect(resp.ContentLength).Should(BeEquivalentTo(-1))
+		Expect(resp.Close).Should(BeFalse())
+	})
+
+	It("Escaped response headers", func() {
+		raw := "X-Path: C:\\new\nX-Lines: one\\ntwo\n"
+		resp, _, err := parseHTTPResponse(200, raw, false)
+		Expect(err).Should(Succeed())
+		Expect(resp.Header.Get("X-Path")).Should(Equal("C:\\new"))
+		Expect(resp.Header.Get("X-Lines")).Should(Equal("one\\ntwo"))
+
+		resp, _, err = parseHTTPResponse(200, raw, true)
+		Expect(err).Should(Succeed())
+		Expect(resp.Header.Get("X-Path")).Should(Equal("C:\new"))
+		Expect(resp.Header.Get("X-Lines")).Should(Equal("one\ntwo"))
+	})
+
+	It("Invalid responses", func() {
+		for _, raw := range []string{
+			"HTTP/1.1\n",
+			"HTTP/x.1 200 OK\n",
+			"HTTP/1.1 20 OK\n",
+			"HTTP/1.1 099 OK\n",
+			"HTTP/1.1 200OK\n",
+			"HTTP/1.1 200 O\x01K\n",
+			"X-Foo bar\n",
+			": bar\n",
+			"X Foo: bar\n",
+			"X-Foo: b\x01ar\n",
+			"Content-Length: ten\n",
+			"Content-Length: -1\n",
+			"Content-Length: +1\n",
+			"Content-Length: 1\nContent-Length: 2\n",
+		} {
+			_, _, err := parseHTTPResponse(200, raw, false)
+			Expect(err).ShouldNot(Succeed(), raw)
+		}
+	})
+
+	It("Status for WSTA", func() {
+		Expect(formatStatus(404, "Not Found")).Should(Equal("404"))
+		Expect(formatStatus(404, "Gone Fishing")).Should(Equal("404 Gone Fishing"))
+		code, reason := parseStatus("404 Gone Fishing")
+		Expect(code).Should(Equal(404))
+		Expect(reason).Should(Equal("Gone Fishing"))
+		code, reason = parseStatus("404")
+		Expect(code).Should(Equal(404))
+		Expect(reason).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Header Serialization", func() {
+	It("Round trip", func() {
+		hdrs := http.Header{}
+		hdrs.Add("Set-Cookie", "a=b; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+		hdrs.Add("Set-Cookie", "c=d; Path=/")
+		hdrs.Add("Date", "Wed, 21 Oct 2015 07:28:00 GMT")
+		hdrs.Add("X-Empty", "")
+		hdrs.Add("X-Multi", "one")
+		hdrs.Add("X-Multi", "")
+		hdrs.Add("X-Multi", "three")
+		hdrs.Add("X-Newline", "line one\r\nline two\nline three")
+		hdrs.Add("X-Backslash", "C:\\Windows\\n")
+		hdrs.Add("X-Spaces", "  leading\tand trailing  ")
+
+		serialized := serializeHeaders(hdrs)
+		Expect(strings.Count(serialized, "\n")).Should(Equal(10))
+
+		parsed := http.Header{}
+		parseHeaders(parsed, serialized)
+		Expect(parsed).Should(Equal(hdrs))
+	})
+
+	It("Multiple values", func() {
+		hdrs := http.Header{}
+		hdrs.Add("Set-Cookie", "a=b")
+		hdrs.Add("Set-Cookie", "c=d")
+		Expect(serializeHeaders(hdrs)).Should(Equal("Set-Cookie: a=b\nSet-Cookie: c=d\n"))
+	})
+
+	It("Parse into existing headers", func() {
+		hdrs := http.Header{}
+		hdrs.Set("Server", "Existing")
+		parseHeaders(hdrs, "Server: one\nServer: two\nX-Foo: bar, baz\n")
+		Expect(hdrs["Server"]).Should(Equal([]string{"Existing", "one", "two"}))
+		Expect(hdrs["X-Foo"]).Should(Equal([]string{"bar, baz"}))
+	})
+
+	It("Parse loosely formatted headers", func() {
+		hdrs := http.Header{}
+		parseHeaders(hdrs, "content-length:10\r\nServer:   Foo\r\nNo colon here\n\n")
+		Expect(hdrs.Get("Content-Length")).Should(Equal("10"))
+		Expect(hdrs.Get("Server")).Should(Equal("Foo"))
+		Expect(len(hdrs)).Should(Equal(2))
+	})
+})
+
+var _ = Describe("Header Deltas", func() {
+	It("Diff headers", func() {
+		orig := http.Header{}
+		orig.Add("Accept", "text/plain")
+		orig.Add("Cookie", "a=b")
+		orig.Add("Via", "one")
+		orig.Add("X-Gone", "yes")
+
+		cur := http.Header{}
+		cur.Add("Accept", "text/plain")
+		cur.Add("Cookie", "c=d")
+		cur.Add("Cookie", "e=f")
+		cur.Add("Via", "one")
+		cur.Add("Via", "two")
+		cur.Add("X-New", "line\nbreak")
+
+		var cmds []string
+		for _, cmd := range diffHeaders(nil, orig, cur) {
+			cmds = append(cmds, cmd.String())
+		}
+		Expect(cmds).Should(Equal([]string{
+			"HSETCookie: c=d",
+			"HADDCookie: e=f",
+			"HADDVia: two",
+			"HDELX-Gone",
+			"HADDX-New: line\\nbreak",
+		}))
+	})
+
+	It("No changes", func() {
+		orig := http.Header{}
+		orig.Add("Accept", "text/plain")
+		Expect(diffHeaders(nil, orig, copyHeaders(orig))).Should(BeEmpty())
+	})
+
+	It("Original spelling", func() {
+		req, fields, err := parseHTTPHeaderList(
+			"x-custom-thing: one\r\nVIA: proxy\r\nx-gone: yes\r\n", false, 0)
+		Expect(err).Should(Succeed())
+
+		cur := copyHeaders(req.Header)
+		cur.Add("X-Custom-Thing", "two")
+		cur.Set("Via", "other")
+		cur.Del("X-Gone")
+		cur.Add("X-New", "new")
+
+		var cmds []string
+		for _, cmd := range diffHeaders(fields, req.Header, cur) {
+			cmds = append(cmds, cmd.String())
+		}
+		Expect(cmds).Should(Equal([]string{
+			"HSETVIA: other",
+			"HADDx-custom-thing: two",
+			"HDELx-gone",
+			"HADDX-New: new",
+		}))
+	})
+})
+
+var _ = Describe("Upstream Parsing", func() {
+	It("Valid upstreams", func() {
+		for in, out := range map[string]string{
+			"backends":                 "backends",
+			"http://example.com":       "http://example.com",
+			"https://example.com:443/": "https://example.com:443",
+			"http://[::1]:8080":        "http://[::1]:8080",
+		} {
+			u, err := parseUpstream(in)
+			Expect(err).Should(Succeed())
+			Expect(u).Should(Equal(out))
+		}
+	})
+
+	It("Invalid upstreams", func() {
+		for _, in := range []string{
+			"",
+			"two words",
+			"back/ends",
+			"http://",
+			"http://example.com/path",
+			"http://example.com?q=1",
+			"http://user@example.com",
+			"http://exa mple.com",
+		} {
+			_, err := parseUpstream(in)
+			Expect(err).ShouldNot(Succeed(), in)
+		}
+	})
+})
+
+var _ = Describe("Output Policy", func() {
+	It("Valid output is unchanged", func() {
+		hdr := http.Header{}
+		hdr.Add("X-Tab", "a\tb")
+		for _, p := range []outputPolicy{policyReject, policyStrip, policyEncode} {
+			clean, err := p.cleanHeaders(hdr)
+			Expect(err).Should(Succeed())
+			Expect(clean).Should(Equal(hdr))
+			uri, err := p.cleanURI("/foo?bar=baz")
+			Expect(err).Should(Succeed())
+			Expect(uri).Should(Equal("/foo?bar=baz"))
+		}
+	})
+
+	It("Reject", func() {
+		_, err := policyReject.clean("header value", "a\r\nb", isHeaderValueChar)
+		Expect(err).ShouldNot(Succeed())
+		_, err = policyReject.clean("header value", "a\x00b", isHeaderValueChar)
+		Expect(err).ShouldNot(Succeed())
+		_, err = policyReject.cleanURI("/foo bar")
+		Expect(err).ShouldNot(Succeed())
+		_, err = policyReject.cleanHeaders(http.Header{"X-Foo:": {"bar"}})
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Strip", func() {
+		v, err := policyStrip.clean("header value", "a\r\n\x00b", isHeaderValueChar)
+		Expect(err).Should(Succeed())
+		Expect(v).Should(Equal("ab"))
+
+		clean, err := policyStrip.cleanHeaders(http.Header{
+			"X-Foo\n": {"bar\n"},
+			"\r\n":    {"gone"},
+			"X-Plain": {"plain"},
+		})
+		Expect(err).Should(Succeed())
+		Expect(clean).Should(Equal(http.Header{
+			"X-Foo":   {"bar"},
+			"X-Plain": {"plain"},
+		}))
+	})
+
+	It("Encode", func() {
+		v, err := policyEncode.clean("header value", "a\r\nb", isHeaderValueChar)
+		Expect(err).Should(Succeed())
+		Expect(v).Should(Equal("a%0D%0Ab"))
+		uri, err := policyEncode.cleanURI("/foo bar\x7f")
+		Expect(err).Should(Succeed())
+		Expect(uri).Should(Equal("/foo%20bar%7F"))
+	})
+
+	It("Status codes", func() {
+		Expect(checkStatus(200)).Should(Succeed())
+		Expect(checkStatus(99)).ShouldNot(Succeed())
+		Expect(checkStatus(1000)).ShouldNot(Succeed())
+	})
+})
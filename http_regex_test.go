@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/*
+ * This is the original regular-expression-based parser. It is kept here so
+ * that we can make sure that the current parser behaves the same way, and
+ * so that we can see how much faster the current one is.
+ */
+
+const (
+	// HTTP grammar regexps borrowed from Trireme source
+	reCtl       = "\\x00-\\x1f\\x7f"
+	reDigits    = "[0-9]"
+	reLws       = "[ \\t]"
+	reNotCtl    = "[^" + reCtl + "]"
+	reSeparator = "\\(\\)<>@,;:\"/\\[\\]?+{} \t\\\\"
+	// Huh? Texts =       "[[ \t][^" + Ctl + "]]"
+	reTexts  = "[^" + reCtl + "]"
+	reTokens = "[^" + reSeparator + reCtl + "]"
+
+	reHeaderLine  = "^(" + reTokens + "+):" + reLws + "*(" + reNotCtl + "*)" + reLws + "*$"
+	reRequestLine = "^(" + reTokens + "+) (" + reTexts + "+) HTTP/(" + reDigits + ").(" + reDigits + ")" + reLws + "*$"
+)
+
+var requestLineRe = regexp.MustCompile(reRequestLine)
+var headerLineRe = regexp.MustCompile(reHeaderLine)
+
+func regexParseHTTPHeaders(rawHeaders string, hasRequestLine bool) (*http.Request, error) {
+	req := http.Request{
+		Header: make(map[string][]string),
+	}
+
+	lines := strings.Split(rawHeaders, "\r\n")
+
+	for i, line := range lines {
+		if hasRequestLine && (i == 0) {
+			err := regexParseRequestLine(line, &req)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			err := regexParseHeaderLine(line, &req)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &req, nil
+}
+
+func regexParseRequestLine(line string, req *http.Request) error {
+	matches := requestLineRe.FindStringSubmatch(line)
+	if matches == nil {
+		return fmt.Errorf("Invalid HTTP request line: \"%s\"", line)
+	}
+
+	url, err := url.ParseRequestURI(matches[2])
+	if err != nil {
+		return err
+	}
+
+	major, err := strconv.Atoi(matches[3])
+	if err != nil {
+		return err
+	}
+	minor, err := strconv.Atoi(matches[4])
+	if err != nil {
+		return err
+	}
+
+	req.URL = url
+	req.RequestURI = matches[2]
+	req.Method = matches[1]
+	req.ProtoMajor = major
+	req.ProtoMinor = minor
+	req.Proto = fmt.Sprintf("HTTP/%d.%d", major, minor)
+	return nil
+}
+
+func regexParseHeaderLine(line string, req *http.Request) error {
+	if "" == line {
+		return nil
+	}
+	matches := headerLineRe.FindStringSubmatch(line)
+	if matches == nil {
+		return fmt.Errorf("Invalid HTTP header line: \"%s\"", line)
+	}
+
+	key := http.CanonicalHeaderKey(matches[1])
+	val := matches[2]
+	req.Header.Add(key, val)
+
+	switch key {
+	case "Host":
+		req.Host = val
+	case "Content-Length":
+		len, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = len
+	}
+
+	return nil
+}
+
+// Requests that the current parser handles differently on purpose are in
+// "intentionalDifferences" below instead.
+var differentialRequests = []string{
+	CompleteRequestLength,
+	CompleteRequestLengthBlankHeader,
+	CompleteRequestNoLength,
+	InvalidRequest,
+	"",
+	"\r\n",
+	"GET / HTTP/1.0\r\n\r\n",
+	"GET / HTTP/1.1",
+	"GET / HTTP/1.1 \t \r\n\r\n",
+	"GET /a b c HTTP/1.1\r\n\r\n",
+	"GET /foo HTTP/1.1 HTTP/1.1\r\n\r\n",
+	"GET /foo?a=b&c=d#frag HTTP/1.1\r\nHost: x\r\n\r\n",
+	"GET  /foo HTTP/1.1\r\n\r\n",
+	"GET /foo  HTTP/1.1\r\n\r\n",
+	"GET /foo HTTP/1.10\r\n\r\n",
+	"GET /foo HTTP/a.1\r\n\r\n",
+	"GET /foo HTTP/1\r\n\r\n",
+	"GET /foo\r\n\r\n",
+	"GET /f\x01oo HTTP/1.1\r\n\r\n",
+	"G(T /foo HTTP/1.1\r\n\r\n",
+	" GET /foo HTTP/1.1\r\n\r\n",
+	"GET foo HTTP/1.1\r\n\r\n",
+	"GET * HTTP/1.1\r\n\r\n",
+	"M\xc3\xa9THOD /\xc3\xa9 HTTP/1.1\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo: bar  \r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo:bar\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo: \t bar \t \r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo: b\ta r\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo: b\x7far\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo: \xe2\x98\x83\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo : bar\r\n\r\n",
+	"GET / HTTP/1.1\r\n: bar\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo bar\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo: bar\nX-Bar: foo\r\n\r\n",
+	"GET / HTTP/1.1\r\nx-foo: one\r\nX-FOO: two\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo: a, b, c\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Foo: bar\r\n\r\nX-After: blank\r\n",
+	"GET / HTTP/1.1\r\nHost: one\r\nHost: two\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-[Foo]: bar\r\n\r\n",
+}
+
+/*
+ * The current parser differs from the original on purpose for these
+ * requests. Each check gets the results of the current parser and then of
+ * the original.
+ */
+var intentionalDifferences = []struct {
+	why   string
+	raw   string
+	check func(req *http.Request, err error, reReq *http.Request, reErr error)
+}{
+	{
+		why: "the original matched any character between the version digits",
+		raw: "GET /foo HTTP/1x1\r\n\r\n",
+		check: func(req *http.Request, err error, reReq *http.Request, reErr error) {
+			Expect(err).Should(MatchError(`Invalid HTTP request line: "GET /foo HTTP/1x1"`))
+			Expect(reErr).Should(Succeed())
+		},
+	},
+	{
+		why: "the host of an absolute-form target goes in the request (RFC 7230)",
+		raw: "GET http://example.com/foo HTTP/1.1\r\n\r\n",
+		check: func(req *http.Request, err error, reReq *http.Request, reErr error) {
+			Expect(err).Should(Succeed())
+			Expect(req.Host).Should(Equal("example.com"))
+			Expect(reErr).Should(Succeed())
+			Expect(reReq.Host).Should(BeEmpty())
+		},
+	},
+	{
+		why: "an authority-form target is a host and port (RFC 7230)",
+		raw: "CONNECT example.com:443 HTTP/1.1\r\n\r\n",
+		check: func(req *http.Request, err error, reReq *http.Request, reErr error) {
+			Expect(err).Should(Succeed())
+			Expect(req.URL.Host).Should(Equal("example.com:443"))
+			Expect(reErr).Should(Succeed())
+			Expect(reReq.URL.Host).Should(BeEmpty())
+		},
+	},
+	{
+		why: "a negative Content-Length would make the body length ambiguous",
+		raw: "GET / HTTP/1.1\r\nContent-Length: -1\r\n\r\n",
+		check: func(req *http.Request, err error, reReq *http.Request, reErr error) {
+			Expect(err).Should(MatchError(`Invalid Content-Length header: "-1"`))
+			Expect(reErr).Should(Succeed())
+			Expect(reReq.ContentLength).Should(BeEquivalentTo(-1))
+		},
+	},
+	{
+		why: "the original took the last of several Content-Length headers",
+		raw: "GET / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n",
+		check: func(req *http.Request, err error, reReq *http.Request, reErr error) {
+			Expect(err).Should(MatchError("Duplicate Content-Length headers"))
+			Expect(reErr).Should(Succeed())
+			Expect(reReq.ContentLength).Should(BeEquivalentTo(2))
+		},
+	},
+	{
+		why: "the error for a bad Content-Length names the header",
+		raw: "GET / HTTP/1.1\r\nContent-Length: 12a\r\n\r\n",
+		check: func(req *http.Request, err error, reReq *http.Request, reErr error) {
+			Expect(err).Should(MatchError(`Invalid Content-Length header: "12a"`))
+			Expect(reErr).Should(MatchError(`strconv.ParseInt: parsing "12a": invalid syntax`))
+		},
+	},
+	{
+		why: "the error for obsolete line folding says what is wrong",
+		raw: "GET / HTTP/1.1\r\nX-Foo: bar\r\n baz\r\n\r\n",
+		check: func(req *http.Request, err error, reReq *http.Request, reErr error) {
+			Expect(err).Should(MatchError(`Obsolete line folding is not allowed: " baz"`))
+			Expect(reErr).Should(MatchError(`Invalid HTTP header line: " baz"`))
+		},
+	},
+}
+
+var _ = Describe("HTTP Parser Differential", func() {
+	It("Matches regular expression parser", func() {
+		for _, raw := range differentialRequests {
+			compareParsers(raw, true)
+			compareParsers(raw, false)
+		}
+	})
+
+	It("Differs from regular expression parser on purpose", func() {
+		for _, d := range intentionalDifferences {
+			By(d.why)
+			req, err := parseHTTPHeaders(d.raw, true)
+			reReq, reErr := regexParseHTTPHeaders(d.raw, true)
+			d.check(req, err, reReq, reErr)
+		}
+	})
+
+	It("Parses headers without allocating more for more headers", func() {
+		allocs := testing.AllocsPerRun(100, func() {
+			parseHTTPHeaders(benchmarkRequest, true)
+		})
+		Expect(allocs).Should(BeNumerically("<=", maxParseAllocs))
+
+		many := manyHeadersRequest(defaultMaxHeaders)
+		manyAllocs := testing.AllocsPerRun(100, func() {
+			parseHTTPHeaders(many, true)
+		})
+		Expect(manyAllocs).Should(Equal(allocs))
+	})
+})
+
+func compareParsers(raw string, hasRequestLine bool) {
+	req, err := parseHTTPHeaders(raw, hasRequestLine)
+	reReq, reErr := regexParseHTTPHeaders(raw, hasRequestLine)
+	desc := fmt.Sprintf("Request %q", raw)
+	if reErr != nil {
+		Expect(err).ShouldNot(Succeed(), desc)
+		Expect(err.Error()).Should(Equal(reErr.Error()), desc)
+		return
+	}
+	Expect(err).Should(Succeed(), desc)
+	Expect(reflect.DeepEqual(req, reReq)).Should(BeTrue(), desc)
+}
+
+/*
+ * The parser can't get down to zero allocations, since everything that it
+ * returns is new: the request, its URL, and the header map with its table.
+ * The header values and the list of headers in their original order get one
+ * slice each, which are allocated up front. So the count does not depend on
+ * the number of headers, at least until the map needs more than one table,
+ * which is far beyond the default limit on the number of headers.
+ */
+const maxParseAllocs = 8
+
+func manyHeadersRequest(n int) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("GET /foo HTTP/1.1\r\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(buf, "X-Header-%d: value %d\r\n", i, i)
+	}
+	buf.WriteString("\r\n")
+	return buf.String()
+}
+
+const benchmarkRequest = "POST /foo/bar/baz?query=yes HTTP/1.1\r\n" +
+	"Host: mybox.example.com\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko)\r\n" +
+	"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+	"Accept-Language: en-US,en;q=0.5\r\n" +
+	"Accept-Encoding: gzip, deflate\r\n" +
+	"Content-Type: application/json\r\n" +
+	"Content-Length: 1234\r\n" +
+	"X-Forwarded-For: 10.0.0.1, 10.0.0.2\r\n" +
+	"Connection: keep-alive\r\n" +
+	"\r\n"
+
+func BenchmarkParseHTTPHeaders(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseHTTPHeaders(benchmarkRequest, true)
+	}
+}
+
+func BenchmarkRegexParseHTTPHeaders(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		regexParseHTTPHeaders(benchmarkRequest, true)
+	}
+}
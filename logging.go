@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/30x/libgozerian/weaver"
+)
+
+/*
+ * Pipelines log using the "weaver" package, and the messages are sent to the
+ * caller as WLOG commands so that they end up in the caller's own log. The
+ * level is global, so that messages the caller doesn't want are never sent.
+ */
+
+var logLevel = int32(weaver.LevelInfo)
+
+func setLogLevel(level weaver.Level) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+func logEnabled(level weaver.Level) bool {
+	return int32(level) <= atomic.LoadInt32(&logLevel)
+}
+
+/*
+ * The message of a WLOG command is the level, the message ID of the request,
+ * and the text. The text is escaped like a header value so that it always
+ * fits on one line, and any other control characters are replaced with "%XX."
+ */
+func makeLogCommand(level weaver.Level, msgID, text string) command {
+	if level < weaver.LevelError {
+		level = weaver.LevelError
+	} else if level > weaver.LevelDebug {
+		level = weaver.LevelDebug
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(strconv.Itoa(int(level)))
+	buf.WriteByte(' ')
+	buf.WriteString(msgID)
+	buf.WriteByte(' ')
+	writeHeaderValue(buf, text)
+	msg, _ := policyEncode.clean("log message", buf.String(), isHeaderValueChar)
+	return command{
+		id:  WLOG,
+		msg: msg,
+	}
+}
+
+/*
+ * Split the message of a WLOG command back into its parts.
+ */
+func parseLogMessage(msg string) (weaver.Level, string, string) {
+	parts := strings.SplitN(msg, " ", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	level, err := strconv.Atoi(parts[0])
+	if err != nil {
+		level = int(weaver.LevelError)
+	}
+	return weaver.Level(level), parts[1], unescapeHeaderValue(parts[2])
+}
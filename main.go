@@ -2,16 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"github.com/30x/libgozerian/weaver"
 )
 
 /*
@@ -55,6 +65,15 @@ func startGozerianServer(port int, proxyTarget, handlerURL string) (*gozerianSer
 		return nil, errors.New(C.GoString(errStr))
 	}
 
+	// We understand the incremental header commands and the status in
+	// ERRR, so ask for them. We also escape the headers that we send.
+	for _, name := range []string{optHeaderDeltas, optErrorStatus, optEscapedHeaders} {
+		err := setDefaultHandlerOption(name, "true")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	addr := net.TCPAddr{
 		Port: port,
 	}
@@ -71,6 +90,19 @@ func startGozerianServer(port int, proxyTarget, handlerURL string) (*gozerianSer
 	return &svr, nil
 }
 
+func setDefaultHandlerOption(name, value string) error {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+	errStr := GoSetHandlerOption(defaultHandlerName, cName, cValue)
+	if errStr != nil {
+		defer C.free(unsafe.Pointer(errStr))
+		return errors.New(C.GoString(errStr))
+	}
+	return nil
+}
+
 func (s *gozerianServer) run() {
 	handler := weaverHandler{
 		target: s.target,
@@ -100,28 +132,87 @@ func (s *gozerianServer) getPort() int {
 	return portNum
 }
 
+var errNoProxying = errors.New("Didn't implement proxying to target yet")
+
 type weaverHandler struct {
 	target string
 	debug  bool
 }
 
-func (m *weaverHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+func (m *weaverHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
+	start := time.Now()
+	resp := &countingWriter{ResponseWriter: w}
 
 	// Although we have nice Go ways to call all these internal functions,
 	// use the public C API so that we can get good test coverage.
 	id := GoCreateRequest(defaultHandlerName)
 	defer GoFreeRequest(id)
 	rid := GoCreateResponse(defaultHandlerName)
-	defer GoFreeResponse(rid)
+	// Free whichever response is current when we return.
+	defer func() { GoFreeResponse(rid) }()
+
+	err := setConnectionInfo(req, id)
+	if err != nil {
+		sendHTTPError(err, resp)
+		return
+	}
 
 	requestBody := &bytes.Buffer{}
 	done := m.processRequest(resp, req, id, rid, requestBody)
-	if !done {
-		m.processResponse(resp, req, id, rid, requestBody)
+	lastRID := uint32(0)
+	for !done {
+		lastRID = rid
+		done = !m.processResponse(resp, req, id, rid, requestBody)
+		if !done {
+			// Every attempt gets a new response, but the same request.
+			// The old response is finished with, so free it now.
+			GoFreeResponse(rid)
+			rid = GoCreateResponse(defaultHandlerName)
+		}
+	}
+
+	// The standard server doesn't say how big the headers were, so only the
+	// bodies count, and there is no real upstream server to time.
+	stats := transactionStatsToC(&weaver.TransactionStats{
+		Status:        resp.status,
+		BytesReceived: int64(requestBody.Len()),
+		BytesSent:     resp.bytes,
+		UpstreamTime:  -1,
+		RequestTime:   time.Since(start),
+	})
+	errMsg := GoCompleteTransaction(id, lastRID, stats)
+	if errMsg != nil {
+		log.Printf("Error completing transaction: %s", C.GoString(errMsg))
+		C.free(unsafe.Pointer(errMsg))
 	}
 }
 
+/*
+ * Keep track of what we sent to the client, for GoCompleteTransaction.
+ */
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(buf)
+	w.bytes += int64(n)
+	return n, err
+}
+
 func (m *weaverHandler) processRequest(
 	resp http.ResponseWriter, req *http.Request,
 	id, rid uint32, requestBody *bytes.Buffer) bool {
@@ -140,7 +231,9 @@ func (m *weaverHandler) processRequest(
 	responseCode := http.StatusOK
 	proxyHeaders := req.Header
 	//proxyPath := req.URL.Path
+	//proxyMethod := req.Method
 	sentHeaders := false
+	redirect := ""
 
 	for cmd != cmdDone && cmd != cmdErrr {
 		rawCmd := GoPollRequest(id, 1)
@@ -150,27 +243,47 @@ func (m *weaverHandler) processRequest(
 		msg := cmdBuf[4:]
 
 		if m.debug {
-			fmt.Printf("Command: \"%s\"\n", cmd)
+			log.Printf("Command: \"%s\"", cmd)
 		}
 
 		switch cmd {
 		case cmdErrr:
-			resp.WriteHeader(http.StatusInternalServerError)
-			resp.Write([]byte(msg))
+			status, errMsg := parseErrorMessage(msg)
+			resp.WriteHeader(status)
+			resp.Write([]byte(errMsg))
 			return true
 		case cmdRbod:
 			requestBody.ReadFrom(req.Body)
+			// Trailers are only available once the body has been read.
+			trailers := trailerValues(req.Trailer)
+			hasTrailers := len(trailers) > 0
 			ptr, len := sliceToPtr(requestBody.Bytes())
-			GoSendRequestBodyChunk(id, 1, ptr, len)
+			if hasTrailers {
+				cTrailers := C.CString(serializeHeaders(trailers))
+				GoSendRequestTrailers(id, ptr, len, cTrailers)
+				C.free(unsafe.Pointer(cTrailers))
+			} else {
+				GoSendRequestBodyChunk(id, 1, ptr, len)
+			}
 			C.free(ptr)
 		case cmdWhdr:
 			if proxying {
-				parseHeaders(proxyHeaders, msg)
+				replaceHeaders(proxyHeaders, msg)
 			} else {
-				parseHeaders(resp.Header(), msg)
+				replaceHeaders(resp.Header(), msg)
+			}
+		case cmdHadd, cmdHset, cmdHdel:
+			if proxying {
+				applyHeaderDelta(proxyHeaders, cmd, msg)
+			} else {
+				applyHeaderDelta(resp.Header(), cmd, msg)
 			}
 		case cmdWURI:
 			//proxyPath = msg
+		case cmdWmth:
+			//proxyMethod = msg
+		case cmdWtgt:
+			// The test server only has one target.
 		case cmdWbod:
 			chunk := getChunkData(msg)
 			if proxying {
@@ -186,6 +299,20 @@ func (m *weaverHandler) processRequest(
 				}
 				resp.Write(chunk)
 			}
+		case cmdWtrl:
+			if !proxying {
+				setTrailers(resp.Header(), msg)
+			}
+		case cmdWvar:
+			// A real server would store the variable somewhere.
+		case cmdWlog:
+			logMessage(msg)
+		case cmdSubr:
+			performSubrequest(msg, req)
+		case cmdWinf:
+			writeInformational(resp, msg)
+		case cmdIrdr:
+			redirect = msg
 		case cmdSwch:
 			proxying = false
 			responseCode, _ = strconv.Atoi(msg)
@@ -207,26 +334,50 @@ func (m *weaverHandler) processRequest(
 	if requestBody.Len() == 0 {
 		requestBody.ReadFrom(req.Body)
 	}
+	if redirect != "" {
+		m.internalRedirect(resp, req, redirect, requestBody)
+		return true
+	}
 	return false
 }
 
+/*
+ * Returns true if the pipeline wants to retry the request.
+ */
 func (m *weaverHandler) processResponse(
 	resp http.ResponseWriter, req *http.Request,
-	id, rid uint32, requestBody *bytes.Buffer) {
+	id, rid uint32, requestBody *bytes.Buffer) bool {
+
+	var cmd string
+	responseCode := http.StatusOK
 
-	// TODO in target proxy mode, actually get target headers
-	respHdrs := &bytes.Buffer{}
-	respHdrs.WriteString("Server: Weaver Test Main\r\n")
+	// We can't actually proxy to a target yet, so let the pipeline see that
+	// as a failure to reach the upstream server.
+	failed := m.target != ""
+	if failed {
+		cMsg := C.CString(errNoProxying.Error())
+		errMsg := GoBeginUpstreamError(rid, id, int32(weaver.UpstreamUnreachable), cMsg)
+		C.free(unsafe.Pointer(cMsg))
+		if errMsg != nil {
+			sendHTTPError(errors.New(C.GoString(errMsg)), resp)
+			C.free(unsafe.Pointer(errMsg))
+			return false
+		}
+		responseCode = http.StatusBadGateway
+	} else {
+		respHdrs := http.Header{}
+		respHdrs.Set("Server", "Weaver Test Main")
 
-	cRespHdrs := C.CString(respHdrs.String())
-	defer C.free(unsafe.Pointer(cRespHdrs))
+		cRespHdrs := C.CString("HTTP/1.1 200 OK\n" + serializeHeaders(respHdrs))
+		defer C.free(unsafe.Pointer(cRespHdrs))
 
-	GoBeginResponse(rid, id, http.StatusOK, cRespHdrs)
+		GoBeginResponse(rid, id, http.StatusOK, cRespHdrs)
+	}
 
-	var cmd string
-	responseCode := http.StatusOK
 	sentHeaders := false
 	wroteBody := false
+	redirect := ""
+	retry := false
 
 	for cmd != cmdDone && cmd != cmdErrr {
 		rawCmd := GoPollResponse(rid, 1)
@@ -236,18 +387,24 @@ func (m *weaverHandler) processResponse(
 		msg := cmdBuf[4:]
 
 		if m.debug {
-			fmt.Printf("Command: \"%s\"\n", cmd)
+			log.Printf("Command: \"%s\"", cmd)
 		}
 
 		switch cmd {
 		case cmdErrr:
-			resp.WriteHeader(http.StatusInternalServerError)
-			resp.Write([]byte(msg))
-			return
-		case cmdWsta, cmdSwch:
+			status, errMsg := parseErrorMessage(msg)
+			resp.WriteHeader(status)
+			resp.Write([]byte(errMsg))
+			return false
+		case cmdWsta:
+			// The standard server can't send a custom reason phrase.
+			responseCode, _ = parseStatus(msg)
+		case cmdSwch:
 			responseCode, _ = strconv.Atoi(msg)
 		case cmdWhdr:
-			parseHeaders(resp.Header(), msg)
+			replaceHeaders(resp.Header(), msg)
+		case cmdHadd, cmdHset, cmdHdel:
+			applyHeaderDelta(resp.Header(), cmd, msg)
 		case cmdRbod:
 			ptr, len := sliceToPtr(requestBody.Bytes())
 			GoSendResponseBodyChunk(rid, 1, ptr, len)
@@ -260,22 +417,237 @@ func (m *weaverHandler) processResponse(
 			chunk := getChunkData(msg)
 			wroteBody = true
 			resp.Write(chunk)
+		case cmdWtrl:
+			setTrailers(resp.Header(), msg)
+		case cmdWvar:
+		case cmdWlog:
+			logMessage(msg)
+		case cmdSubr:
+			performSubrequest(msg, req)
+		case cmdWinf:
+			writeInformational(resp, msg)
+		case cmdIrdr:
+			redirect = msg
+		case cmdRtry:
+			// There's only one fake target, so the new upstream doesn't matter.
+			retry = true
 		case cmdDone:
 		default:
 			sendHTTPError(fmt.Errorf("Unexpected command %s", cmd), resp)
 		}
 	}
 
-	if m.target == "" {
-		// Pretend that we are a proxy for another server by echoing the request
-		if !sentHeaders {
-			resp.WriteHeader(http.StatusOK)
+	if retry && !sentHeaders {
+		return true
+	}
+	if redirect != "" && !sentHeaders {
+		m.internalRedirect(resp, req, redirect, requestBody)
+		return false
+	}
+
+	if failed {
+		if !sentHeaders && responseCode == http.StatusBadGateway {
+			// The pipeline left the error alone, so send our own.
+			sendHTTPError(withStatus(http.StatusBadGateway, errNoProxying), resp)
+		} else if !sentHeaders {
+			resp.WriteHeader(responseCode)
 		}
-		if !wroteBody {
-			requestBody.WriteTo(resp)
+		return false
+	}
+
+	// Pretend that we are a proxy for another server by echoing the request
+	if !sentHeaders {
+		resp.WriteHeader(http.StatusOK)
+	}
+	if !wroteBody {
+		requestBody.WriteTo(resp)
+	}
+	return false
+}
+
+/*
+ * Send an informational response, such as 103 Early Hints, right away. The
+ * standard server sends whatever headers are set at the time, and they stay
+ * set for the final response.
+ */
+func writeInformational(resp http.ResponseWriter, msg string) {
+	line := msg
+	rest := ""
+	if end := strings.IndexByte(msg, '\n'); end >= 0 {
+		line = msg[:end]
+		rest = msg[end+1:]
+	}
+	status, err := strconv.Atoi(line)
+	if err != nil {
+		log.Printf("Invalid informational response: %q", line)
+		return
+	}
+	hdrs := http.Header{}
+	parseHeaders(hdrs, rest)
+	for name, vals := range hdrs {
+		resp.Header()[name] = vals
+	}
+	resp.WriteHeader(status)
+}
+
+/*
+ * Pass along what we know about the client connection, just like a real
+ * frontend would.
+ */
+func setConnectionInfo(req *http.Request, id uint32) error {
+	remoteAddr := C.CString(req.RemoteAddr)
+	defer C.free(unsafe.Pointer(remoteAddr))
+
+	var localAddr *C.char
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = C.CString(addr.String())
+		defer C.free(unsafe.Pointer(localAddr))
+	}
+
+	var tlsVersion, cipherSuite uint32
+	var serverName, peerCerts *C.char
+	if req.TLS != nil {
+		tlsVersion = uint32(req.TLS.Version)
+		cipherSuite = uint32(req.TLS.CipherSuite)
+		serverName = C.CString(req.TLS.ServerName)
+		defer C.free(unsafe.Pointer(serverName))
+		certs := &bytes.Buffer{}
+		for _, cert := range req.TLS.PeerCertificates {
+			pem.Encode(certs, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
 		}
-	} else {
-		sendHTTPError(fmt.Errorf("Didn't implement proxying to target yet"), resp)
+		peerCerts = C.CString(certs.String())
+		defer C.free(unsafe.Pointer(peerCerts))
+	}
+
+	errStr := GoSetRequestConnectionInfo(id, remoteAddr, localAddr,
+		tlsVersion, cipherSuite, serverName, peerCerts, 0)
+	if errStr != nil {
+		defer C.free(unsafe.Pointer(errStr))
+		return errors.New(C.GoString(errStr))
+	}
+	return nil
+}
+
+/*
+ * WHDR replaces the whole set of headers, rather than adding to them.
+ */
+func replaceHeaders(hdrs http.Header, msg string) {
+	for k := range hdrs {
+		delete(hdrs, k)
+	}
+	parseHeaders(hdrs, msg)
+}
+
+func applyHeaderDelta(hdrs http.Header, cmd, msg string) {
+	if cmd == cmdHdel {
+		hdrs.Del(msg)
+		return
+	}
+	delta := http.Header{}
+	parseHeaders(delta, msg)
+	for k, v := range delta {
+		if cmd == cmdHset {
+			hdrs.Del(k)
+		}
+		for _, val := range v {
+			hdrs.Add(k, val)
+		}
+	}
+}
+
+/*
+ * The context key that marks a request that has already been redirected.
+ */
+type redirectedKey struct{}
+
+/*
+ * The test server has no named locations, so it handles an internal redirect
+ * to a path by starting over with the new path. A request is only
+ * redirected once, so that it can't loop forever.
+ */
+func (m *weaverHandler) internalRedirect(
+	resp http.ResponseWriter, req *http.Request, location string, requestBody *bytes.Buffer) {
+
+	if !strings.HasPrefix(location, "/") || req.Context().Value(redirectedKey{}) != nil {
+		sendHTTPError(fmt.Errorf("Cannot redirect to %s", location), resp)
+		return
+	}
+	newURL, err := url.ParseRequestURI(location)
+	if err != nil {
+		sendHTTPError(err, resp)
+		return
+	}
+	newReq := req.WithContext(context.WithValue(req.Context(), redirectedKey{}, true))
+	newReq.URL = newURL
+	newReq.RequestURI = location
+	newReq.Body = ioutil.NopCloser(bytes.NewReader(requestBody.Bytes()))
+	m.ServeHTTP(resp, newReq)
+}
+
+/*
+ * Make a subrequest for the pipeline using the standard HTTP client. A real
+ * server would use its own connections to upstream servers. A URI without
+ * a host goes to the same host as the original request.
+ */
+func performSubrequest(msg string, orig *http.Request) {
+	lines := strings.SplitN(msg, "\n", 2)
+	fields := strings.Fields(lines[0])
+	if len(fields) < 3 {
+		log.Printf("Invalid subrequest: %s", lines[0])
+		return
+	}
+	subID, _ := strconv.ParseUint(fields[0], 16, 32)
+
+	var body io.Reader
+	if len(fields) > 3 {
+		body = bytes.NewReader(getChunkData(fields[3]))
+	}
+	uri := fields[2]
+	if !strings.Contains(uri, "://") {
+		uri = "http://" + orig.Host + uri
+	}
+
+	resp, err := func() (*http.Response, error) {
+		req, err := http.NewRequest(fields[1], uri, body)
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) > 1 {
+			parseHeaders(req.Header, lines[1])
+		}
+		if host := req.Header.Get("Host"); host != "" {
+			req.Host = host
+		}
+		return http.DefaultClient.Do(req)
+	}()
+	if err != nil {
+		cMsg := C.CString(err.Error())
+		cErr := GoFailSubrequest(uint32(subID), cMsg)
+		C.free(unsafe.Pointer(cMsg))
+		C.free(unsafe.Pointer(cErr))
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	respHdrs := fmt.Sprintf("%s %s\n%s", resp.Proto, resp.Status, serializeHeaders(resp.Header))
+	cHdrs := C.CString(respHdrs)
+	ptr, len := sliceToPtr(respBody)
+	cErr := GoSendSubrequestResponse(uint32(subID), uint32(resp.StatusCode), cHdrs, ptr, len)
+	C.free(unsafe.Pointer(cHdrs))
+	C.free(ptr)
+	C.free(unsafe.Pointer(cErr))
+}
+
+/*
+ * WTRL replaces the trailers. The standard HTTP server sends headers with
+ * this prefix as trailers, even if they were not declared in advance.
+ */
+func setTrailers(hdrs http.Header, msg string) {
+	trailers := http.Header{}
+	parseHeaders(trailers, msg)
+	for k, v := range trailers {
+		hdrs[http.TrailerPrefix+k] = v
 	}
 }
 
@@ -296,10 +668,26 @@ func getChunkDataByID(id int32) []byte {
 	return buf
 }
 
+/*
+ * Write a message from WLOG to the standard logger, which is where a real
+ * server would put it in its own log.
+ */
+func logMessage(msg string) {
+	level, msgID, text := parseLogMessage(msg)
+	log.Printf("[%s] %s: %s", logLevelNames[level], msgID, text)
+}
+
+var logLevelNames = map[weaver.Level]string{
+	weaver.LevelError: "error",
+	weaver.LevelWarn:  "warn",
+	weaver.LevelInfo:  "info",
+	weaver.LevelDebug: "debug",
+}
+
 func sendHTTPError(err error, resp http.ResponseWriter) {
-	fmt.Printf("Error: %s\n", err.Error())
+	log.Printf("Error: %s", err.Error())
 	resp.Header().Set("Content-Type", "text/plain")
-	resp.WriteHeader(http.StatusInternalServerError)
+	resp.WriteHeader(errorStatus(err))
 	resp.Write([]byte(err.Error()))
 }
 
@@ -308,11 +696,13 @@ func main() {
 	var target string
 	var testHandler bool
 	var handlerURI string
+	var logLevel int
 
 	flag.IntVar(&port, "p", 0, "(required) Port to listen on")
 	flag.StringVar(&target, "u", "", "(optional) Target proxy URL")
 	flag.StringVar(&handlerURI, "h", "", "(optional) URL of handler to create")
 	flag.BoolVar(&testHandler, "t", false, "(optional) Install a set of test handlers")
+	flag.IntVar(&logLevel, "l", int(weaver.LevelInfo), "(optional) Log level, from 0 (errors) to 3 (debug)")
 	flag.Parse()
 
 	if !flag.Parsed() {
@@ -323,10 +713,11 @@ func main() {
 	if testHandler {
 		handlerURI = TestHandlerURI
 	}
+	GoSetLogLevel(int32(logLevel))
 
 	server, err := startGozerianServer(port, target, handlerURI)
 	if err != nil {
-		fmt.Printf("Cannot start server: %s\n", err)
+		log.Printf("Cannot start server: %s", err)
 		os.Exit(3)
 	}
 
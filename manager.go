@@ -2,6 +2,7 @@ package main
 
 import (
 	cryptoRand "crypto/rand"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/30x/gozerian/c_gateway"
 	"github.com/30x/gozerian/pipeline"
+	"github.com/30x/libgozerian/weaver"
 )
 
 /*
@@ -28,20 +30,32 @@ import (
 
 var requests = make(map[uint32]*request)
 var responses = make(map[uint32]*response)
-var pipeDefs = make(map[string]pipeline.Definition)
+var handlers = make(map[string]*handler)
 var managerLatch = &sync.Mutex{}
 var lastID uint32
 var oneInit sync.Once
 
+/*
+ * A handler is a pipeline definition, plus the options that the caller
+ * has set for it.
+ */
+type handler struct {
+	pd      pipeline.Definition
+	options handlerOptions
+}
+
 /*
  * Common interface for requests and responses
  */
 type commandHandler interface {
-	Commands() chan command
+	SendCommand(cmd command)
 	Bodies() chan []byte
 	Headers() http.Header
 	ResponseWritten()
 	StartRead()
+	SetTrailers(trailers http.Header)
+	EndRead()
+	SetRedirect(location string) error
 }
 
 /*
@@ -65,6 +79,10 @@ func createHandler(id, cfgURI string) error {
 	var pipeDef pipeline.Definition
 	if configURI.Scheme == URNScheme && configURI.Opaque == TestHandlerURIName {
 		pipeDef = &TestPipeDef{}
+	} else if configURI.Scheme == URNScheme && configURI.Opaque == HeadersOnlyHandlerURIName {
+		pipeDef = &TestPipeDef{
+			capabilities: RequestHeaders,
+		}
 	} else if configURI.Scheme == URNScheme && configURI.Opaque == BadHandlerURIName {
 		// This is a pre-defined "bad handler" so that we can unit-test an error from this routine.
 		return fmt.Errorf("Invalid handler %s", BadHandlerURI)
@@ -76,7 +94,10 @@ func createHandler(id, cfgURI string) error {
 	}
 
 	managerLatch.Lock()
-	pipeDefs[id] = pipeDef
+	handlers[id] = &handler{
+		pd:      pipeDef,
+		options: defaultHandlerOptions(),
+	}
 	managerLatch.Unlock()
 	return nil
 }
@@ -86,10 +107,39 @@ func createHandler(id, cfgURI string) error {
  */
 func destroyHandler(id string) {
 	managerLatch.Lock()
-	delete(pipeDefs, id)
+	delete(handlers, id)
 	managerLatch.Unlock()
 }
 
+/*
+ * Set one of the options in options.go on an existing handler.
+ */
+func setHandlerOption(id, name, value string) error {
+	managerLatch.Lock()
+	defer managerLatch.Unlock()
+
+	h := handlers[id]
+	if h == nil {
+		return fmt.Errorf("Unknown handler: %s", id)
+	}
+	return h.options.set(name, value)
+}
+
+/*
+ * Return what the pipeline for a handler needs to see, or zero if the
+ * handler does not exist.
+ */
+func getHandlerCapabilities(handlerID string) Capability {
+	managerLatch.Lock()
+	defer managerLatch.Unlock()
+
+	h := handlers[handlerID]
+	if h == nil {
+		return 0
+	}
+	return capabilitiesOf(h.pd)
+}
+
 /*
  * Create a new request object. It should be used once and only once.
  */
@@ -97,14 +147,14 @@ func createRequest(handlerID string) uint32 {
 	managerLatch.Lock()
 	defer managerLatch.Unlock()
 
-	pd := pipeDefs[handlerID]
-	if pd == nil {
+	h := handlers[handlerID]
+	if h == nil {
 		return 0
 	}
 	// After 2BB requests we will roll over. That should not be a problem.
 	lastID++
 	id := lastID
-	req := newRequest(id, pd)
+	req := newRequest(id, h.pd, h.options)
 	requests[id] = req
 	return id
 }
@@ -116,13 +166,13 @@ func createResponse(handlerID string) uint32 {
 	managerLatch.Lock()
 	defer managerLatch.Unlock()
 
-	handler := pipeDefs[handlerID]
-	if handler == nil {
+	h := handlers[handlerID]
+	if h == nil {
 		return 0
 	}
 	lastID++
 	id := lastID
-	r := newResponse(id, pipeDefs[handlerID])
+	r := newResponse(id, h.pd, h.options)
 	responses[id] = r
 	return id
 }
@@ -152,6 +202,19 @@ func beginResponse(responseID, requestID, status uint32, rawHeaders string) erro
 	return r.begin(status, rawHeaders, req)
 }
 
+func beginUpstreamError(responseID, requestID uint32, failure *weaver.UpstreamError) error {
+	r := getResponse(responseID)
+	if r == nil {
+		return fmt.Errorf("Unknown response: %d", responseID)
+	}
+	req := getRequest(requestID)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", requestID)
+	}
+
+	return r.beginUpstreamError(failure, req)
+}
+
 /*
  * Get status of the request, without blocking. The result will be a single
  * string that represents a command, or an empty string if there is none.
@@ -162,11 +225,16 @@ func pollRequest(id uint32, block bool) string {
 	if req == nil {
 		return "ERRRUnknown request"
 	}
+	if req.options.binaryFraming {
+		return createErrorCommand(
+			errors.New("Request uses binary framing"), req.options.errorStatus).String()
+	}
 
-	if block {
-		return req.poll()
+	cmd, ok := req.poll(block)
+	if !ok {
+		return ""
 	}
-	return req.pollNB()
+	return cmd.String()
 }
 
 func pollResponse(id uint32, block bool) string {
@@ -174,11 +242,54 @@ func pollResponse(id uint32, block bool) string {
 	if resp == nil {
 		return "ERRRUnknown response"
 	}
+	if resp.options.binaryFraming {
+		return createErrorCommand(
+			errors.New("Response uses binary framing"), resp.options.errorStatus).String()
+	}
 
-	if block {
-		return resp.poll()
+	cmd, ok := resp.poll(block)
+	if !ok {
+		return ""
 	}
-	return resp.pollNB()
+	return cmd.String()
+}
+
+/*
+ * Like pollRequest, but for handlers that use binary framing. It returns
+ * nil if there is no command.
+ */
+func pollRequestFrame(id uint32, block bool) []byte {
+	req := getRequest(id)
+	if req == nil {
+		return createErrorCommand(errors.New("Unknown request"), false).frame()
+	}
+	if !req.options.binaryFraming {
+		return createErrorCommand(
+			errors.New("Request uses text framing"), req.options.errorStatus).frame()
+	}
+
+	cmd, ok := req.poll(block)
+	if !ok {
+		return nil
+	}
+	return cmd.frame()
+}
+
+func pollResponseFrame(id uint32, block bool) []byte {
+	resp := getResponse(id)
+	if resp == nil {
+		return createErrorCommand(errors.New("Unknown response"), false).frame()
+	}
+	if !resp.options.binaryFraming {
+		return createErrorCommand(
+			errors.New("Response uses text framing"), resp.options.errorStatus).frame()
+	}
+
+	cmd, ok := resp.poll(block)
+	if !ok {
+		return nil
+	}
+	return cmd.frame()
 }
 
 /*
@@ -186,8 +297,13 @@ func pollResponse(id uint32, block bool) string {
  */
 func freeRequest(id uint32) {
 	managerLatch.Lock()
+	req := requests[id]
 	delete(requests, id)
 	managerLatch.Unlock()
+
+	if req != nil {
+		failSubrequestsOf(req)
+	}
 }
 
 func freeResponse(id uint32) {
@@ -196,6 +312,42 @@ func freeResponse(id uint32) {
 	managerLatch.Unlock()
 }
 
+func setRequestScheme(id uint32, scheme string) {
+	req := getRequest(id)
+	if req != nil {
+		req.setScheme(scheme)
+	}
+}
+
+func setRequestHTTPVersion(id uint32, major int) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	if !isPseudoHeaderVersion(major) {
+		return fmt.Errorf("Invalid HTTP version: %d", major)
+	}
+	req.setHTTPVersion(major)
+	return nil
+}
+
+func setRequestConnectionInfo(id uint32, conn *connectionInfo) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	req.setConnectionInfo(conn)
+	return nil
+}
+
+func setRequestVariable(id uint32, name, value string) error {
+	req := getRequest(id)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", id)
+	}
+	return req.vars.set(name, value)
+}
+
 /*
  * Send some data to act as the request body.
  */
@@ -209,6 +361,24 @@ func sendResponseBodyChunk(id uint32, last bool, chunk []byte) {
 	sendChunk(resp, last, chunk)
 }
 
+/*
+ * Send the last chunk of the body along with the trailers that follow it.
+ */
+func sendRequestTrailers(id uint32, chunk []byte, rawTrailers string) {
+	// A nil pointer would not be a nil commandHandler.
+	req := getRequest(id)
+	if req != nil {
+		sendTrailers(req, chunk, rawTrailers, req.options.escapedHeaders)
+	}
+}
+
+func sendResponseTrailers(id uint32, chunk []byte, rawTrailers string) {
+	resp := getResponse(id)
+	if resp != nil {
+		sendTrailers(resp, chunk, rawTrailers, resp.options.escapedHeaders)
+	}
+}
+
 /*
  * One-time seeding of the global random-number generator so that we can
  * quickly generate unique request IDs.
@@ -244,6 +414,15 @@ func sendChunk(h commandHandler, last bool, chunk []byte) {
 	}
 }
 
+func sendTrailers(h commandHandler, chunk []byte, rawTrailers string, unescape bool) {
+	trailers := http.Header{}
+	parseHeaderFields(trailers, rawTrailers, false, unescape)
+	// This happens before the channel is closed, so the pipeline will see
+	// the trailers by the time that it reads to the end of the body.
+	h.SetTrailers(trailers)
+	sendChunk(h, true, chunk)
+}
+
 func getRequest(id uint32) *request {
 	managerLatch.Lock()
 	defer managerLatch.Unlock()
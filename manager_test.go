@@ -2,12 +2,24 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/30x/libgozerian/weaver"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -47,6 +59,57 @@ var _ = Describe("Go Management Interface", func() {
 		Expect(cmd).Should(Equal("DONE"))
 	})
 
+	It("Basic Request Synchronous", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+
+		// Pipeline never touched the body so it should already be done
+		cmd := pollRequest(id, false)
+		Expect(cmd).Should(Equal("DONE"))
+	})
+
+	It("Full command queue", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/logalot", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(getRequest(id).yielded).ShouldNot(BeNil())
+
+		for i := 0; i <= commandQueueSize; i++ {
+			Expect(pollRequest(id, true)).Should(HaveSuffix(fmt.Sprintf(" Message %d", i)))
+		}
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Complete request modification synchronous", func() {
+		err := beginRequest(id, makeRequestHeaders("POST", "/completerequest", "text/plain", 12))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, false)
+		Expect(cmd).Should(MatchRegexp("^WURI.*"))
+		cmd = pollRequest(id, false)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		cmd = pollRequest(id, false)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		readBodyData(cmd)
+		cmd = pollRequest(id, false)
+		Expect(cmd).Should(Equal("DONE"))
+	})
+
+	It("Read request body without blocking", func() {
+		msg := []byte("Hello, World!")
+		err := beginRequest(id, makeRequestHeaders("POST", "/readbody", "text/plain", len(msg)))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, false)
+		Expect(cmd).Should(Equal("RBOD"))
+		Expect(getRequest(id).yielded).ShouldNot(BeNil())
+		cmd = pollRequest(id, false)
+		Expect(cmd).Should(BeEmpty())
+		sendRequestBodyChunk(id, true, msg)
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(Equal("DONE"))
+		Expect(bytes.Equal(msg, lastTestBody)).Should(BeTrue())
+	})
+
 	It("Slow Basic Request", func() {
 		err := beginRequest(id, makeRequestHeaders("GET", "/slowpass", "", 0))
 		Expect(err).Should(Succeed())
@@ -67,6 +130,81 @@ var _ = Describe("Go Management Interface", func() {
 
 		cmd := pollRequest(id, true)
 		Expect(cmd).Should(MatchRegexp("^ERRR.+"))
+		// Only callers that ask for it get the status.
+		Expect(cmd).ShouldNot(MatchRegexp("^ERRR[0-9]"))
+	})
+
+	It("Error status", func() {
+		err := createHandler("errstatus", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("errstatus")
+		Expect(setHandlerOption("errstatus", optErrorStatus, "true")).Should(Succeed())
+		Expect(setHandlerOption("errstatus", optErrorStatus, "maybe")).ShouldNot(Succeed())
+
+		eid := createRequest("errstatus")
+		defer freeRequest(eid)
+		err = beginRequest(eid, InvalidRequest)
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(eid, true)
+		Expect(cmd).Should(MatchRegexp("^ERRR400 .+"))
+		status, msg := parseErrorMessage(cmd[4:])
+		Expect(status).Should(Equal(400))
+		Expect(msg).Should(HavePrefix("Invalid"))
+
+		eid2 := createRequest("errstatus")
+		defer freeRequest(eid2)
+		err = beginRequest(eid2, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(eid2, true)).Should(Equal("DONE"))
+		erid := createResponse("errstatus")
+		defer freeResponse(erid)
+		err = beginResponse(erid, eid2, 200, "HTTP/1.1 OK\n")
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(erid, true)).Should(MatchRegexp("^ERRR502 .+"))
+
+		status, msg = parseErrorMessage("Unknown request")
+		Expect(status).Should(Equal(500))
+		Expect(msg).Should(Equal("Unknown request"))
+	})
+
+	It("Request header limits", func() {
+		err := createHandler("limits", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("limits")
+		Expect(setHandlerOption("limits", optMaxHeaders, "2")).Should(Succeed())
+		Expect(setHandlerOption("limits", optMaxHeaderBytes, "100")).Should(Succeed())
+		Expect(setHandlerOption("limits", optErrorStatus, "true")).Should(Succeed())
+
+		lid := createRequest("limits")
+		defer freeRequest(lid)
+		err = beginRequest(lid, "GET /pass HTTP/1.1\r\nHost: a\r\nX-One: 1\r\n\r\n")
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(lid, true)).Should(Equal("DONE"))
+
+		lid2 := createRequest("limits")
+		defer freeRequest(lid2)
+		err = beginRequest(lid2, "GET /pass HTTP/1.1\r\nHost: a\r\nX-One: 1\r\nX-Two: 2\r\n\r\n")
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(lid2, true)).Should(Equal("ERRR431 Request has more than 2 headers"))
+
+		lid3 := createRequest("limits")
+		defer freeRequest(lid3)
+		err = beginRequest(lid3, "GET /pass HTTP/1.1\r\nX-Long: "+strings.Repeat("x", 100)+"\r\n\r\n")
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(lid3, true)).Should(Equal("ERRR431 Request headers are longer than 100 bytes"))
+
+		Expect(setHandlerOption("limits", optMaxHeaders, "-1")).ShouldNot(Succeed())
+		Expect(setHandlerOption("limits", optMaxHeaderBytes, "lots")).ShouldNot(Succeed())
+	})
+
+	It("Invalid Response Status", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, "HTTP/1.1 OK\n")
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(MatchRegexp("^ERRR.+"))
 	})
 
 	It("Not Found", func() {
@@ -206,6 +344,84 @@ var _ = Describe("Go Management Interface", func() {
 		Expect(cmd).Should(Equal("DONE"))
 	})
 
+	It("Modify request headers with deltas", func() {
+		err := createHandler("deltas", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("deltas")
+		err = setHandlerOption("deltas", optHeaderDeltas, "true")
+		Expect(err).Should(Succeed())
+		did := createRequest("deltas")
+		defer freeRequest(did)
+
+		err = beginRequest(did, makeRequestHeaders("POST", "/editheaders", "text/plain", 10))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(did, true)).Should(Equal("HDELContent-Type"))
+		Expect(pollRequest(did, true)).Should(Equal("HSETHost: example.com"))
+		Expect(pollRequest(did, true)).Should(Equal("HADDX-Apigee-Test: one"))
+		Expect(pollRequest(did, true)).Should(Equal("HADDX-Apigee-Test: two"))
+		Expect(pollRequest(did, true)).Should(Equal("DONE"))
+	})
+
+	It("Modify request headers without deltas", func() {
+		err := beginRequest(id, makeRequestHeaders("POST", "/editheaders", "text/plain", 10))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Content-Type")).Should(BeEmpty())
+		Expect(hdrs.Get("Host")).Should(Equal("example.com"))
+		Expect(hdrs["X-Apigee-Test"]).Should(Equal([]string{"one", "two"}))
+		Expect(hdrs.Get("Content-Length")).Should(Equal("10"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Modify request headers keeps order and case", func() {
+		err := beginRequest(id, "GET /writeheaders HTTP/1.1\r\n"+
+			"user-agent: test\r\n"+
+			"HOST: localhost:1234\r\n"+
+			"Accept: */*\r\n"+
+			"\r\n")
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(Equal("WHDR" +
+			"user-agent: test\n" +
+			"HOST: localhost:1234\n" +
+			"Accept: */*\n" +
+			"Server: Go Test Stuff\n" +
+			"X-Apigee-Test: HeaderTest\n"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Changed request headers move to the end", func() {
+		err := beginRequest(id, "POST /editheaders HTTP/1.1\r\n"+
+			"host: localhost:1234\r\n"+
+			"content-type: text/plain\r\n"+
+			"Content-Length: 10\r\n"+
+			"\r\n")
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(Equal("WHDR" +
+			"Content-Length: 10\n" +
+			"host: example.com\n" +
+			"X-Apigee-Test: one\n" +
+			"X-Apigee-Test: two\n"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Handler options", func() {
+		err := setHandlerOption(testHandler, "notAnOption", "true")
+		Expect(err).ShouldNot(Succeed())
+		err = setHandlerOption(testHandler, optHeaderDeltas, "maybe")
+		Expect(err).ShouldNot(Succeed())
+		err = setHandlerOption("notAHandler", optHeaderDeltas, "true")
+		Expect(err).ShouldNot(Succeed())
+	})
+
 	It("Modify request URL", func() {
 		err := beginRequest(id, makeRequestHeaders("GET", "/writepath", "", 0))
 		Expect(err).Should(Succeed())
@@ -223,6 +439,521 @@ var _ = Describe("Go Management Interface", func() {
 		Expect(cmd).Should(Equal("DONE"))
 	})
 
+	It("Modify request URL in place", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writequery", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("WURI/writequery?foo=bar"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Modify request target", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writetarget?a=b", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("WURIhttps://example.com:8443/writetarget?a=b"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Modify request method", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writemethod", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("WMTHPOST"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid request method", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writebadmethod", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal(`ERRRInvalid HTTP method: "GET /evil HTTP/1.1"`))
+	})
+
+	It("Set upstream and Host", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writeupstream", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("WTGThttps://backend.example.com:8443"))
+		Expect(pollRequest(id, true)).Should(Equal("WHDRHost: backend.example.com\n"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		// The request is gone, so it's too late.
+		Expect(getRequest(id).host.SetUpstream("backends")).Should(Equal(errRequestSent))
+	})
+
+	It("Set upstream group", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writeupstreamgroup", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("WTGTbackends"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Log messages", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/log", "", 0))
+		Expect(err).Should(Succeed())
+
+		msgID := getRequest(id).msgID
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(Equal("WLOG2 " + msgID + " Hello,\\nWorld!"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		level, logID, text := parseLogMessage(cmd[4:])
+		Expect(level).Should(Equal(weaver.LevelInfo))
+		Expect(logID).Should(Equal(msgID))
+		Expect(text).Should(Equal("Hello,\nWorld!"))
+	})
+
+	It("Log level", func() {
+		setLogLevel(weaver.LevelDebug)
+		defer setLogLevel(weaver.LevelInfo)
+		err := beginRequest(id, makeRequestHeaders("GET", "/log", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WLOG2 "))
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WLOG3 .+ Nobody wants to see this$"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		setLogLevel(weaver.LevelError)
+		lid := createRequest(testHandler)
+		defer freeRequest(lid)
+		err = beginRequest(lid, makeRequestHeaders("GET", "/log", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(lid, true)).Should(Equal("DONE"))
+	})
+
+	It("Log messages stay on one line", func() {
+		cmd := makeLogCommand(weaver.Level(7), "id", "a\x00b\r\n\tc")
+		Expect(cmd.String()).Should(Equal("WLOG3 id a%00b\\r\\n\\tc"))
+	})
+
+	It("Subrequest", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/subrequest", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^SUBR[0-9a-f]+ POST http://auth.example.com/check [0-9a-f]+\n"))
+		Expect(cmd).Should(HaveSuffix("\nHost: auth.example.com\nX-Check: yes\n"))
+		fields := strings.Fields(strings.SplitN(cmd[4:], "\n", 2)[0])
+		Expect(string(readBodyData("WBOD" + fields[3]))).Should(Equal("who?"))
+		subID, err := strconv.ParseUint(fields[0], 16, 32)
+		Expect(err).Should(Succeed())
+
+		err = sendSubrequestResponse(uint32(subID), 0, "HTTP/1.1 200 OK\nX-User: bob\n", []byte("bob"))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(ContainSubstring("\nX-Auth: 200 bob\n"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		// It's already done.
+		Expect(failSubrequest(uint32(subID), "Too late")).ShouldNot(Succeed())
+	})
+
+	It("Subrequest for a freed request", func() {
+		fid := createRequest(testHandler)
+		err := beginRequest(fid, makeRequestHeaders("GET", "/subrequest", "", 0))
+		Expect(err).Should(Succeed())
+		req := getRequest(fid)
+
+		cmd := pollRequest(fid, true)
+		Expect(cmd).Should(MatchRegexp("^SUBR"))
+		fields := strings.Fields(cmd[4:])
+		readBodyData("WBOD" + fields[3])
+		subID, err := strconv.ParseUint(fields[0], 16, 32)
+		Expect(err).Should(Succeed())
+		freeRequest(fid)
+
+		// The pipeline does not wait for a reply that can never come.
+		next, _ := req.poll(true)
+		Expect(next.String()).Should(ContainSubstring("\nX-Auth-Error: " + errRequestFreed.Error() + "\n"))
+		next, _ = req.poll(true)
+		Expect(next.String()).Should(Equal("DONE"))
+		Expect(failSubrequest(uint32(subID), "Too late")).ShouldNot(Succeed())
+	})
+
+	It("Failed subrequest", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/subrequest", "", 0))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^SUBR"))
+		rejectSubrequest(cmd[4:], errors.New("Connection refused"))
+		Expect(pollRequest(id, true)).Should(ContainSubstring("\nX-Auth-Error: Connection refused\n"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		plain, _ := http.NewRequest("GET", "http://localhost/", nil)
+		_, err = weaver.Transport(plain).RoundTrip(plain)
+		Expect(err).Should(Equal(weaver.ErrNoHost))
+	})
+
+	It("Internal redirect", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/redirectrequest", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^WHDR"))
+		Expect(pollRequest(id, true)).Should(Equal("IRDR/return201"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getRequest(id).host.Redirect("/toolate")).Should(Equal(errRequestSent))
+	})
+
+	It("Internal redirect to named location", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/redirectnamed", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("IRDR@fallback"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Internal redirect from response", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/redirectresponse", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("IRDR/return201"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Internal redirect after reading the response", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/redirectafterbody", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("text/plain", 6))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseBodyChunk(rid, true, []byte("Hello!"))
+		Expect(pollResponse(rid, true)).Should(Equal("WVARredirect_error: " + errResponseSent.Error()))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Retry", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/retry", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(ContainSubstring("\nX-Retry-Error: Only a response can be retried\n"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 503, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RTRYhttps://backup.example.com"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		// The second response is the last one that the pipeline gets to see.
+		rid2 := createResponse(testHandler)
+		defer freeResponse(rid2)
+		err = beginResponse(rid2, id, 503, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid2, true)).Should(ContainSubstring("\nX-Retry-Error: Request has reached its limit of 1 retries\n"))
+		Expect(pollResponse(rid2, true)).Should(Equal("DONE"))
+	})
+
+	It("Retry with same upstream", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/retryonce", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(MatchRegexp("^WVAR"))
+		Expect(pollResponse(rid, true)).Should(Equal("RTRY"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		rid2 := createResponse(testHandler)
+		defer freeResponse(rid2)
+		err = beginResponse(rid2, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid2, true)).Should(ContainSubstring("\nX-Retried: yes\n"))
+		Expect(pollResponse(rid2, true)).Should(Equal("DONE"))
+	})
+
+	It("Upstream error", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/upstreamerror", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginUpstreamError(rid, id, &weaver.UpstreamError{
+			Kind:    weaver.UpstreamUnreachable,
+			Message: "Connection refused",
+		})
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("WSTA503 Try Again Later"))
+		Expect(pollResponse(rid, true)).Should(Equal("WHDRContent-Type: text/plain\n"))
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD"))
+		Expect(string(readBodyData(cmd))).Should(Equal("Upstream failed: Connection refused"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Upstream timeout retried", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/upstreamerror", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginUpstreamError(rid, id, &weaver.UpstreamError{Kind: weaver.UpstreamTimeout})
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RTRY"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		// A real response is left alone.
+		rid2 := createResponse(testHandler)
+		defer freeResponse(rid2)
+		err = beginResponse(rid2, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid2, true)).Should(Equal("DONE"))
+	})
+
+	It("Upstream error unchanged", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginUpstreamError(rid, id, &weaver.UpstreamError{Kind: 99})
+		Expect(err).ShouldNot(Succeed())
+		err = beginUpstreamError(rid, id, &weaver.UpstreamError{Kind: weaver.UpstreamInvalidResponse})
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Complete transaction", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/logtransaction", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 201, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		stats := &weaver.TransactionStats{
+			Status:       201,
+			BytesSent:    100,
+			UpstreamTime: time.Millisecond,
+			RequestTime:  2 * time.Millisecond,
+		}
+		Expect(completeTransaction(id, rid, stats)).Should(Succeed())
+		var result testTransaction
+		Eventually(testTransactions).Should(Receive(&result))
+		Expect(result.stats).Should(Equal(stats))
+		Expect(result.responseStatus).Should(Equal(201))
+		Expect(result.err).Should(Equal(errTransactionComplete))
+		Expect(result.req).ShouldNot(BeIdenticalTo(getRequest(id).req))
+		Expect(result.req.Body).Should(Equal(http.NoBody))
+		getRequest(id).req.Header.Set("X-Later", "yes")
+		Expect(result.req.Header).ShouldNot(HaveKey("X-Later"))
+		Expect(getRequest(id).host.Redirect("/toolate")).Should(Equal(errTransactionComplete))
+
+		// The logger only runs once.
+		Expect(completeTransaction(id, rid, stats)).Should(Equal(errTransactionComplete))
+		Consistently(testTransactions).ShouldNot(Receive())
+
+		Expect(completeTransaction(id, 12345, stats)).ShouldNot(Succeed())
+		Expect(completeTransaction(12345, 0, stats)).ShouldNot(Succeed())
+	})
+
+	It("Complete transaction without response", func() {
+		Expect(completeTransaction(id, 0, &weaver.TransactionStats{})).ShouldNot(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/logtransaction", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		Expect(completeTransaction(id, rid, &weaver.TransactionStats{})).ShouldNot(Succeed())
+		Expect(completeTransaction(id, 0, &weaver.TransactionStats{Status: 200})).Should(Succeed())
+		var result testTransaction
+		Eventually(testTransactions).Should(Receive(&result))
+		Expect(result.stats.Status).Should(Equal(200))
+		Expect(result.responseStatus).Should(BeZero())
+	})
+
+	It("Early hints", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/earlyhints", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("WINF103\nLink: </style.css>; rel=preload; as=style\n"))
+		// The request still goes to the target.
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(getRequest(id).proxying).Should(BeTrue())
+	})
+
+	It("100 Continue", func() {
+		err := beginRequest(id,
+			"POST /continue HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("WINF100\n"))
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestBodyChunk(id, true, []byte("Hello"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(string(lastTestBody)).Should(Equal("Hello"))
+
+		id2 := createRequest(testHandler)
+		defer freeRequest(id2)
+		err = beginRequest(id2,
+			"POST /continue HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 500\r\n\r\n")
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id2, true)).Should(Equal("SWCH417"))
+	})
+
+	It("Retry limit", func() {
+		err := createHandler("noretry", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("noretry")
+		Expect(setHandlerOption("noretry", optMaxRetries, "0")).Should(Succeed())
+		Expect(setHandlerOption("noretry", optMaxRetries, "-1")).ShouldNot(Succeed())
+		Expect(setHandlerOption("noretry", optMaxRetries, "lots")).ShouldNot(Succeed())
+
+		nid := createRequest("noretry")
+		defer freeRequest(nid)
+		err = beginRequest(nid, makeRequestHeaders("GET", "/retry", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(nid, true)).Should(MatchRegexp("^WHDR"))
+		Expect(pollRequest(nid, true)).Should(Equal("DONE"))
+
+		nrid := createResponse("noretry")
+		defer freeResponse(nrid)
+		err = beginResponse(nrid, nid, 503, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(nrid, true)).Should(ContainSubstring("\nX-Retry-Error: Request has reached its limit of 0 retries\n"))
+		Expect(pollResponse(nrid, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid redirect locations", func() {
+		for _, loc := range []string{"", "@", "@two words", "relative", "/a b", "http://example.com/"} {
+			Expect(checkRedirectLocation(loc)).ShouldNot(Succeed(), loc)
+		}
+		Expect(checkRedirectLocation("/a?b=c")).Should(Succeed())
+	})
+
+	It("Request URL has scheme and host", func() {
+		setRequestScheme(id, "https")
+		err := beginRequest(id, makeRequestHeaders("GET", "/saverequest?a=b", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(lastTestRequest.URL.String()).Should(Equal("https://localhost:1234/saverequest?a=b"))
+	})
+
+	It("HTTP/3 request", func() {
+		Expect(setRequestHTTPVersion(id, 3)).Should(Succeed())
+		Expect(setRequestHTTPVersion(id, 1)).ShouldNot(Succeed())
+		Expect(setRequestHTTPVersion(9999999, 3)).ShouldNot(Succeed())
+		err := beginRequest(id, ":method: GET\r\n:scheme: https\r\n"+
+			":authority: example.com\r\n:path: /saverequest\r\n")
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(lastTestRequest.Proto).Should(Equal("HTTP/3.0"))
+		Expect(lastTestRequest.ProtoMajor).Should(Equal(3))
+	})
+
+	It("Absolute request target", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "http://example.com/saverequest", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(lastTestRequest.URL.String()).Should(Equal("http://example.com/saverequest"))
+	})
+
+	It("Connection info", func() {
+		certPEM := makeTestCertificate()
+		conn, err := newConnectionInfo("10.1.2.3:5678", "[::1]:443",
+			tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			"example.com", certPEM, true)
+		Expect(err).Should(Succeed())
+		Expect(setRequestConnectionInfo(id, conn)).Should(Succeed())
+
+		err = beginRequest(id, makeRequestHeaders("GET", "/saverequest", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		req := lastTestRequest
+		Expect(req.RemoteAddr).Should(Equal("10.1.2.3:5678"))
+		Expect(req.URL.Scheme).Should(Equal("https"))
+		localAddr := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		Expect(localAddr.String()).Should(Equal("[::1]:443"))
+		Expect(req.TLS).ShouldNot(BeNil())
+		Expect(req.TLS.Version).Should(BeEquivalentTo(tls.VersionTLS12))
+		Expect(req.TLS.CipherSuite).Should(Equal(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256))
+		Expect(req.TLS.ServerName).Should(Equal("example.com"))
+		Expect(req.TLS.PeerCertificates).Should(HaveLen(1))
+		Expect(req.TLS.PeerCertificates[0].Subject.CommonName).Should(Equal("client"))
+		Expect(req.TLS.VerifiedChains).Should(HaveLen(1))
+	})
+
+	It("Connection info without TLS", func() {
+		conn, err := newConnectionInfo("10.1.2.3:5678", "", 0, 0, "ignored", "", false)
+		Expect(err).Should(Succeed())
+		Expect(setRequestConnectionInfo(id, conn)).Should(Succeed())
+
+		err = beginRequest(id, makeRequestHeaders("GET", "/saverequest", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(lastTestRequest.RemoteAddr).Should(Equal("10.1.2.3:5678"))
+		Expect(lastTestRequest.URL.Scheme).Should(Equal("http"))
+		Expect(lastTestRequest.TLS).Should(BeNil())
+	})
+
+	It("Connection info with other addresses", func() {
+		conn, err := newConnectionInfo("[fe80::1%eth0]:5678", "unix:/run/nginx.sock",
+			0, 0, "", "", false)
+		Expect(err).Should(Succeed())
+		Expect(setRequestConnectionInfo(id, conn)).Should(Succeed())
+
+		err = beginRequest(id, makeRequestHeaders("GET", "/saverequest", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		Expect(lastTestRequest.RemoteAddr).Should(Equal("[fe80::1%eth0]:5678"))
+		localAddr := lastTestRequest.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		Expect(localAddr.Network()).Should(Equal("unix"))
+		Expect(localAddr.String()).Should(Equal("/run/nginx.sock"))
+
+		addr, err := parseTCPAddr("[fe80::1%eth0]:443")
+		Expect(err).Should(Succeed())
+		Expect(addr.IP.String()).Should(Equal("fe80::1"))
+		Expect(addr.Zone).Should(Equal("eth0"))
+		Expect(addr.Port).Should(Equal(443))
+		_, err = parseTCPAddr("10.1.2.3%eth0:443")
+		Expect(err).ShouldNot(Succeed())
+
+		conn, err = newConnectionInfo("unix:", "", 0, 0, "", "", false)
+		Expect(err).Should(Succeed())
+		Expect(conn.remoteAddr).Should(Equal("unix:"))
+	})
+
+	It("Invalid connection info", func() {
+		_, err := newConnectionInfo("nowhere", "", 0, 0, "", "", false)
+		Expect(err).ShouldNot(Succeed())
+		_, err = newConnectionInfo("", "example.com:80", 0, 0, "", "", false)
+		Expect(err).ShouldNot(Succeed())
+		_, err = newConnectionInfo("", "", tls.VersionTLS12, 0, "",
+			"-----BEGIN CERTIFICATE-----\nbm90IGEgY2VydA==\n-----END CERTIFICATE-----\n", false)
+		Expect(err).ShouldNot(Succeed())
+		Expect(setRequestConnectionInfo(9999999, &connectionInfo{})).ShouldNot(Succeed())
+	})
+
+	It("Variables", func() {
+		Expect(setRequestVariable(id, "upstream", "backend")).Should(Succeed())
+		err := beginRequest(id, makeRequestHeaders("GET", "/variables", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("WVARpipeline_result: upstream is backend"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		Expect(setRequestVariable(id, "upstream_status", "200")).Should(Succeed())
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("WVARresponse_result: status is 200"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		val, ok := getRequest(id).vars.Variable("pipeline_result")
+		Expect(ok).Should(BeTrue())
+		Expect(val).Should(Equal("upstream is backend"))
+	})
+
+	It("Invalid variables", func() {
+		Expect(setRequestVariable(id, "bad name", "x")).ShouldNot(Succeed())
+		Expect(setRequestVariable(id, "", "x")).ShouldNot(Succeed())
+		Expect(setRequestVariable(9999999, "name", "x")).ShouldNot(Succeed())
+		Expect(getRequest(id).vars.SetVariable("a:b", "x")).ShouldNot(Succeed())
+
+		plain, _ := http.NewRequest("GET", "http://localhost/", nil)
+		_, ok := weaver.Variable(plain, "upstream")
+		Expect(ok).Should(BeFalse())
+		Expect(weaver.SetVariable(plain, "upstream", "x")).Should(Equal(weaver.ErrNoHost))
+	})
+
 	It("Modify request body no read", func() {
 		err := beginRequest(id, makeRequestHeaders("POST", "/replacebody", "text/plain", 12))
 		Expect(err).Should(Succeed())
@@ -244,6 +975,63 @@ var _ = Describe("Go Management Interface", func() {
 		Expect(cmd).Should(Equal("DONE"))
 	})
 
+	It("Binary framing", func() {
+		err := createHandler("binary", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("binary")
+		Expect(setHandlerOption("binary", optFraming, "binary")).Should(Succeed())
+
+		bid := createRequest("binary")
+		defer freeRequest(bid)
+		err = beginRequest(bid, makeRequestHeaders("POST", "/replacebody", "text/plain", 12))
+		Expect(err).Should(Succeed())
+
+		code, flags, payload := readFrame(pollRequestFrame(bid, true))
+		Expect(code).Should(Equal("WBOD"))
+		Expect(flags).Should(BeZero())
+		Expect(payload).Should(HaveLen(4))
+		body := getChunkDataByID(int32(binary.BigEndian.Uint32(payload)))
+		Expect(string(body)).Should(Equal("Hello! I am the server!"))
+
+		code, flags, payload = readFrame(pollRequestFrame(bid, true))
+		Expect(code).Should(Equal("DONE"))
+		Expect(flags).Should(Equal(uint32(frameFlagLast)))
+		Expect(payload).Should(BeEmpty())
+
+		brid := createResponse("binary")
+		defer freeResponse(brid)
+		err = beginResponse(brid, bid, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		code, _, _ = readFrame(pollResponseFrame(brid, true))
+		Expect(code).Should(Equal("DONE"))
+		Expect(pollResponseFrame(brid, false)).Should(BeNil())
+	})
+
+	It("Binary framing must match the handler", func() {
+		code, flags, payload := readFrame(pollRequestFrame(id, false))
+		Expect(code).Should(Equal("ERRR"))
+		Expect(flags).Should(Equal(uint32(frameFlagLast)))
+		Expect(string(payload)).Should(Equal("Request uses text framing"))
+		code, _, _ = readFrame(pollResponseFrame(9999999, false))
+		Expect(code).Should(Equal("ERRR"))
+
+		err := createHandler("binary", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("binary")
+		Expect(setHandlerOption("binary", optFraming, "binary")).Should(Succeed())
+		bid := createRequest("binary")
+		defer freeRequest(bid)
+		Expect(pollRequest(bid, false)).Should(Equal("ERRRRequest uses binary framing"))
+
+		Expect(setHandlerOption("binary", optFraming, "morse")).ShouldNot(Succeed())
+	})
+
+	It("Binary frames may contain NUL", func() {
+		code, _, payload := readFrame(createErrorCommand(errors.New("a\x00b"), false).frame())
+		Expect(code).Should(Equal("ERRR"))
+		Expect(payload).Should(Equal([]byte("a\x00b")))
+	})
+
 	It("Modify response only", func() {
 		err := beginRequest(id, makeRequestHeaders("GET", "/return201", "", 0))
 		Expect(err).Should(Succeed())
@@ -314,6 +1102,29 @@ var _ = Describe("Go Management Interface", func() {
 		Expect(cmd).Should(Equal("DONE"))
 	})
 
+	It("Retry", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("GET", "/retry", "", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+
+		result = processResponseSync(testHandler, result.requestID, 503,
+			makeResponseHeaders("", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		Expect(result.retry).Should(BeTrue())
+		Expect(result.upstream).Should(Equal("https://backup.example.com"))
+	})
+
+	It("Early hints", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("GET", "/earlyhints", "", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.switched).Should(BeFalse())
+		Expect(result.informational).Should(Equal(
+			[]string{"103\nLink: </style.css>; rel=preload; as=style\n"}))
+	})
+
 	It("Complete response modification", func() {
 		err := beginRequest(id, makeRequestHeaders("POST", "/completeresponse", "text/plain", 12))
 		Expect(err).Should(Succeed())
@@ -375,6 +1186,24 @@ var _ = Describe("Go Management Interface", func() {
 		Expect(cmd).Should(Equal("DONE"))
 	})
 
+	It("Modify Response Headers keeps order and case", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writeresponseheaders", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200,
+			"server: upstream\nX-ZZZ: last\nContent-Type: text/plain\n")
+		Expect(err).Should(Succeed())
+
+		cmd := pollResponse(rid, true)
+		Expect(cmd).Should(Equal("WHDR" +
+			"server: upstream\n" +
+			"X-ZZZ: last\n" +
+			"Content-Type: text/plain\n" +
+			"X-Apigee-Responseheader: yes\n"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
 	It("Modify Response Body", func() {
 		err := beginRequest(id, makeRequestHeaders("GET", "/transformbody", "", 0))
 		Expect(err).Should(Succeed())
@@ -421,6 +1250,138 @@ var _ = Describe("Go Management Interface", func() {
 		Expect(cmd).Should(Equal("DONE"))
 	})
 
+	It("Modify Response Status keeps reason", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/responseerror", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 0, "HTTP/1.1 200 Fine Thanks\nContent-Length: 0\n")
+		Expect(err).Should(Succeed())
+		// The upstream reason was for the old status, so it's gone now.
+		Expect(pollResponse(rid, true)).Should(Equal("WSTA500"))
+	})
+
+	It("Modify Response Reason", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writereason", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("WSTA299 Mostly OK"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Invalid Response Headers", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, "Content-Type text/plain\n")
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(MatchRegexp("^ERRR.*"))
+	})
+
+	It("Header injection rejected", func() {
+		for _, path := range []string{"/injectheader", "/injectheadername", "/injectquery"} {
+			rejID := createRequest(testHandler)
+			err := beginRequest(rejID, makeRequestHeaders("GET", path, "", 0))
+			Expect(err).Should(Succeed())
+			Expect(pollRequest(rejID, true)).Should(MatchRegexp("^ERRRInvalid character in .+"))
+			freeRequest(rejID)
+		}
+
+		err := beginRequest(id, makeRequestHeaders("GET", "/injectreason", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(MatchRegexp("^ERRRInvalid character in status reason: .+"))
+	})
+
+	It("Header injection rejected in response", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/injectresponseheader", "", 0))
+		Expect(err).Should(Succeed())
+		// Nothing at all is sent before the error.
+		Expect(pollRequest(id, true)).Should(MatchRegexp("^ERRRInvalid character in header value: .+"))
+
+		vid := createRequest(testHandler)
+		defer freeRequest(vid)
+		Expect(getRequest(vid).vars.SetVariable("name", "a\r\nb")).ShouldNot(Succeed())
+	})
+
+	It("Invalid status from pipeline", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/returnbadstatus", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("ERRRInvalid HTTP status code: 1"))
+	})
+
+	It("Header injection stripped", func() {
+		err := createHandler("strip", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("strip")
+		Expect(setHandlerOption("strip", optOutputPolicy, "strip")).Should(Succeed())
+
+		sid := createRequest("strip")
+		defer freeRequest(sid)
+		err = beginRequest(sid, makeRequestHeaders("GET", "/injectheader", "", 0))
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(sid, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR"))
+		Expect(cmd).Should(ContainSubstring("\nX-Injected: fooX-Evil: yes"))
+		Expect(pollRequest(sid, true)).Should(Equal("DONE"))
+
+		sid2 := createRequest("strip")
+		defer freeRequest(sid2)
+		err = beginRequest(sid2, makeRequestHeaders("GET", "/injectheadername", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(sid2, true)).Should(ContainSubstring("\nX-BadName: foo"))
+		Expect(pollRequest(sid2, true)).Should(Equal("DONE"))
+
+		sid3 := createRequest("strip")
+		defer freeRequest(sid3)
+		err = beginRequest(sid3, makeRequestHeaders("GET", "/injectresponseheader", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(sid3, true)).Should(Equal("SWCH200"))
+		Expect(pollRequest(sid3, true)).Should(ContainSubstring("X-Injected: foobar"))
+		Expect(pollRequest(sid3, true)).Should(Equal("DONE"))
+
+		srid := createResponse("strip")
+		defer freeResponse(srid)
+		sid4 := createRequest("strip")
+		defer freeRequest(sid4)
+		err = beginRequest(sid4, makeRequestHeaders("GET", "/injectreason", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(sid4, true)).Should(Equal("DONE"))
+		err = beginResponse(srid, sid4, 200, makeResponseHeaders("", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(srid, true)).Should(Equal("WSTA299 OKX-Evil: yes"))
+		Expect(pollResponse(srid, true)).Should(Equal("DONE"))
+	})
+
+	It("Header injection encoded", func() {
+		err := createHandler("encode", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("encode")
+		Expect(setHandlerOption("encode", optOutputPolicy, "encode")).Should(Succeed())
+
+		eid := createRequest("encode")
+		defer freeRequest(eid)
+		err = beginRequest(eid, makeRequestHeaders("GET", "/injectheader", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(eid, true)).Should(ContainSubstring("\nX-Injected: foo%0D%0AX-Evil: yes"))
+		Expect(pollRequest(eid, true)).Should(Equal("DONE"))
+
+		eid2 := createRequest("encode")
+		defer freeRequest(eid2)
+		err = beginRequest(eid2, makeRequestHeaders("GET", "/injectquery", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(eid2, true)).Should(Equal("WURI/injectquery?foo=bar%0D%0AX-Evil:%20yes"))
+		Expect(pollRequest(eid2, true)).Should(Equal("DONE"))
+
+		Expect(setHandlerOption("encode", optOutputPolicy, "ignore")).ShouldNot(Succeed())
+	})
+
 	It("Modify Response Using Writer", func() {
 		err := beginRequest(id, makeRequestHeaders("GET", "/responseerror2", "", 0))
 		Expect(err).Should(Succeed())
@@ -485,6 +1446,184 @@ var _ = Describe("Go Management Interface", func() {
 		Expect(cmd).Should(Equal("DONE"))
 	})
 
+	It("Read request trailers", func() {
+		msg := []byte("Hello, World!")
+		err := beginRequest(id, "POST /readtrailers HTTP/1.1\r\n"+
+			"Transfer-Encoding: chunked\r\nTrailer: X-Checksum, X-Other\r\n\r\n")
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("RBOD"))
+		sendRequestTrailers(id, msg, "X-Checksum: 1234\nX-Extra: yes\n")
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		Expect(lastTestTrailers.Get("X-Checksum")).Should(Equal("1234"))
+		Expect(lastTestTrailers.Get("X-Extra")).Should(Equal("yes"))
+		Expect(lastTestTrailers).Should(HaveKey("X-Other"))
+		Expect(lastTestTrailers["X-Other"]).Should(BeEmpty())
+	})
+
+	It("Modify request trailers", func() {
+		err := beginRequest(id, makeRequestHeaders("POST", "/writetrailers", "text/plain", 10))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("WTRLX-Apigee-Checksum: 1234\n"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Send response trailers", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/returntrailers", "", 0))
+		Expect(err).Should(Succeed())
+
+		Expect(pollRequest(id, true)).Should(Equal("SWCH200"))
+		cmd := pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WHDR.*"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("Trailer")).Should(Equal("Grpc-Status"))
+		cmd = pollRequest(id, true)
+		Expect(cmd).Should(MatchRegexp("^WBOD.*"))
+		readBodyData(cmd)
+		Expect(pollRequest(id, true)).Should(Equal("WTRLGrpc-Message: OK\nGrpc-Status: 0\n"))
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+	})
+
+	It("Read response trailers", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/readresponsetrailers", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, "Trailer: Grpc-Status\n")
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseTrailers(rid, []byte("Hello!"), "grpc-status: 0\n")
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+
+		Expect(lastTestTrailers.Get("Grpc-Status")).Should(Equal("0"))
+	})
+
+	It("Escaped trailers", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/readresponsetrailers", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+		err = beginResponse(rid, id, 200, "Trailer: X-Path\n")
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("RBOD"))
+		sendResponseTrailers(rid, nil, "X-Path: C:\\new\n")
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+		// Without the option, the caller's value is not changed.
+		Expect(lastTestTrailers.Get("X-Path")).Should(Equal("C:\\new"))
+
+		err = createHandler("escaped", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("escaped")
+		Expect(setHandlerOption("escaped", optEscapedHeaders, "true")).Should(Succeed())
+
+		eid := createRequest("escaped")
+		defer freeRequest(eid)
+		err = beginRequest(eid, makeRequestHeaders("GET", "/readresponsetrailers", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(eid, true)).Should(Equal("DONE"))
+		erid := createResponse("escaped")
+		defer freeResponse(erid)
+		err = beginResponse(erid, eid, 200, "Trailer: X-Path\n")
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(erid, true)).Should(Equal("RBOD"))
+		sendResponseTrailers(erid, nil, "X-Path: C:\\new\n")
+		Expect(pollResponse(erid, true)).Should(Equal("DONE"))
+		Expect(lastTestTrailers.Get("X-Path")).Should(Equal("C:\new"))
+	})
+
+	It("Trailers for unknown IDs", func() {
+		Expect(func() {
+			sendRequestTrailers(12345, []byte("Hello!"), "X-Checksum: 1234\n")
+		}).ShouldNot(Panic())
+		Expect(func() {
+			sendResponseTrailers(12345, []byte("Hello!"), "grpc-status: 0\n")
+		}).ShouldNot(Panic())
+	})
+
+	It("Modify response trailers", func() {
+		err := beginRequest(id, makeRequestHeaders("GET", "/writeresponsetrailers", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(id, true)).Should(Equal("DONE"))
+
+		err = beginResponse(rid, id, 200, "Trailer: Grpc-Status\n")
+		Expect(err).Should(Succeed())
+		Expect(pollResponse(rid, true)).Should(Equal("WTRLGrpc-Status: 0\n"))
+		Expect(pollResponse(rid, true)).Should(Equal("DONE"))
+	})
+
+	It("Handler capabilities", func() {
+		Expect(getHandlerCapabilities(testHandler)).Should(Equal(AllCapabilities))
+		Expect(getHandlerCapabilities("notAHandler")).Should(BeZero())
+
+		err := createHandler("headersOnly", HeadersOnlyHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("headersOnly")
+		Expect(getHandlerCapabilities("headersOnly")).Should(Equal(RequestHeaders))
+	})
+
+	It("Undeclared request body is never requested", func() {
+		err := createHandler("headersOnly", HeadersOnlyHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("headersOnly")
+		hid := createRequest("headersOnly")
+		Expect(hid).ShouldNot(BeZero())
+		defer freeRequest(hid)
+
+		err = beginRequest(hid, makeRequestHeaders("POST", "/readbody", "text/plain", 13))
+		Expect(err).Should(Succeed())
+
+		cmd := pollRequest(hid, false)
+		Expect(cmd).Should(Equal("WLOG0 " + getRequest(hid).msgID +
+			" Error reading body: Pipeline did not declare that it reads the message body"))
+		cmd = pollRequest(hid, false)
+		Expect(cmd).Should(Equal("DONE"))
+		Expect(lastTestBody).Should(BeEmpty())
+	})
+
+	It("Headers-only handler runs inline", func() {
+		err := createHandler("headersOnly", HeadersOnlyHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("headersOnly")
+
+		hid := createRequest("headersOnly")
+		defer freeRequest(hid)
+		err = beginRequest(hid, makeRequestHeaders("GET", "/pass", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(pollRequest(hid, false)).Should(Equal("DONE"))
+		// ...without ever starting a goroutine
+		Expect(getRequest(hid).yielded).Should(BeNil())
+
+		// The queue doesn't limit what an inline pipeline can send.
+		hid2 := createRequest("headersOnly")
+		defer freeRequest(hid2)
+		err = beginRequest(hid2, makeRequestHeaders("GET", "/logalot", "", 0))
+		Expect(err).Should(Succeed())
+		Expect(getRequest(hid2).yielded).Should(BeNil())
+		for i := 0; i <= commandQueueSize; i++ {
+			Expect(pollRequest(hid2, false)).Should(HaveSuffix(fmt.Sprintf(" Message %d", i)))
+		}
+		Expect(pollRequest(hid2, false)).Should(Equal("DONE"))
+	})
+
+	It("Undeclared subrequests fail", func() {
+		err := createHandler("headersOnly", HeadersOnlyHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("headersOnly")
+		hid := createRequest("headersOnly")
+		defer freeRequest(hid)
+
+		err = beginRequest(hid, makeRequestHeaders("GET", "/subrequest", "", 0))
+		Expect(err).Should(Succeed())
+		cmd := pollRequest(hid, false)
+		Expect(cmd).Should(MatchRegexp("^WHDR"))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, cmd[4:])
+		Expect(hdrs.Get("X-Auth-Error")).Should(Equal(errSubrequestsNotDeclared.Error()))
+		Expect(pollRequest(hid, false)).Should(Equal("DONE"))
+	})
+
 	It("Bad handler", func() {
 		err := createHandler("bad", BadHandlerURI)
 		Expect(err).ShouldNot(Succeed())
@@ -495,6 +1634,173 @@ var _ = Describe("Go Management Interface", func() {
 	})
 })
 
+var _ = Describe("Synchronous Processing", func() {
+	It("Request and response", func() {
+		msg := []byte("Hello, World!")
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("POST", "/readbody", "text/plain", len(msg)), msg)
+		Expect(result.err).Should(BeEmpty())
+		Expect(result.requestID).ShouldNot(BeZero())
+		defer freeRequest(result.requestID)
+		Expect(result.switched).Should(BeFalse())
+		Expect(result.uri).Should(BeEmpty())
+		Expect(result.headersSet).Should(BeFalse())
+		Expect(result.bodyChanged).Should(BeFalse())
+		Expect(bytes.Equal(msg, lastTestBody)).Should(BeTrue())
+
+		result = processResponseSync(testHandler, result.requestID, 200,
+			makeResponseHeaders("text/plain", len(msg)), msg)
+		Expect(result.err).Should(BeEmpty())
+		Expect(result.status).Should(BeZero())
+		Expect(result.bodyChanged).Should(BeFalse())
+	})
+
+	It("Complete request modification", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("POST", "/completerequest", "text/plain", 12), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.switched).Should(BeFalse())
+		Expect(result.uri).Should(Equal("/totallynewurl"))
+		Expect(result.headersSet).Should(BeTrue())
+		hdrs := http.Header{}
+		parseHeaders(hdrs, result.headers)
+		Expect(hdrs.Get("X-Apigee-Test")).Should(Equal("Complete"))
+		Expect(result.bodyChanged).Should(BeTrue())
+		Expect(string(result.body)).Should(Equal("Hello Again! Time for a complete rewrite!"))
+	})
+
+	It("Modify request headers with deltas", func() {
+		err := createHandler("syncdeltas", TestHandlerURI)
+		Expect(err).Should(Succeed())
+		defer destroyHandler("syncdeltas")
+		err = setHandlerOption("syncdeltas", optHeaderDeltas, "true")
+		Expect(err).Should(Succeed())
+
+		result := processRequestSync("syncdeltas",
+			makeRequestHeaders("POST", "/editheaders", "text/plain", 10), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.headersSet).Should(BeTrue())
+		hdrs := http.Header{}
+		parseHeaders(hdrs, result.headers)
+		Expect(hdrs.Get("Content-Type")).Should(BeEmpty())
+		Expect(hdrs.Get("Host")).Should(Equal("example.com"))
+		Expect(hdrs["X-Apigee-Test"]).Should(Equal([]string{"one", "two"}))
+	})
+
+	It("Modify request method", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("GET", "/writemethod", "", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.method).Should(Equal("POST"))
+		Expect(result.uri).Should(BeEmpty())
+	})
+
+	It("Log messages", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("GET", "/log", "", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.logs).Should(HaveLen(1))
+		Expect(result.logs[0]).Should(HaveSuffix(" Hello,\\nWorld!"))
+	})
+
+	It("Subrequests fail", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("GET", "/subrequest", "", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.headers).Should(ContainSubstring("\nX-Auth-Error: Subrequests are not supported here\n"))
+	})
+
+	It("Internal redirect", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("GET", "/redirectnamed", "", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.redirect).Should(Equal("@fallback"))
+	})
+
+	It("Set upstream", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("GET", "/writeupstreamgroup", "", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.upstream).Should(Equal("backends"))
+		Expect(result.uri).Should(BeEmpty())
+	})
+
+	It("Complete response modification", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("POST", "/completeresponse", "text/plain", 13),
+			[]byte("Hello, World!"))
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.switched).Should(BeTrue())
+		Expect(result.status).Should(Equal(201))
+		hdrs := http.Header{}
+		parseHeaders(hdrs, result.headers)
+		Expect(hdrs.Get("X-Apigee-Test")).Should(Equal("Complete"))
+		Expect(string(result.body)).Should(Equal("Hello Again! Time for a complete rewrite!"))
+	})
+
+	It("Modify request trailers", func() {
+		msg := []byte("Hello, World!")
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("POST", "/writetrailers", "text/plain", len(msg)), msg)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.trailersSet).Should(BeTrue())
+		Expect(result.trailers).Should(Equal("X-Apigee-Checksum: 1234\n"))
+	})
+
+	It("Variables", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("GET", "/variables", "", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+		Expect(result.variables).Should(Equal([]string{"pipeline_result: upstream is "}))
+
+		Expect(setRequestVariable(result.requestID, "upstream_status", "200")).Should(Succeed())
+		result = processResponseSync(testHandler, result.requestID, 200,
+			makeResponseHeaders("", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		Expect(result.variables).Should(Equal([]string{"response_result: status is 200"}))
+	})
+
+	It("Transform response body", func() {
+		result := processRequestSync(testHandler,
+			makeRequestHeaders("GET", "/transformbodychunks", "", 0), nil)
+		Expect(result.err).Should(BeEmpty())
+		defer freeRequest(result.requestID)
+
+		msg := []byte("Hello, Response Server!")
+		result = processResponseSync(testHandler, result.requestID, 200,
+			makeResponseHeaders("text/plain", len(msg)), msg)
+		Expect(result.err).Should(BeEmpty())
+		Expect(result.switched).Should(BeFalse())
+		hdrs := http.Header{}
+		parseHeaders(hdrs, result.headers)
+		Expect(hdrs.Get("X-Apigee-Transformed")).Should(Equal("yes"))
+		Expect(result.bodyChanged).Should(BeTrue())
+		Expect(string(result.body)).Should(Equal("{Hello, Response Server!}"))
+	})
+
+	It("Invalid request", func() {
+		result := processRequestSync(testHandler, InvalidRequest, nil)
+		defer freeRequest(result.requestID)
+		Expect(result.err).ShouldNot(BeEmpty())
+	})
+
+	It("Unknown handler", func() {
+		result := processRequestSync("notAHandler", CompleteRequestNoLength, nil)
+		Expect(result.err).ShouldNot(BeEmpty())
+		Expect(result.requestID).Should(BeZero())
+	})
+})
+
 var _ = Describe("Unique ID test", func() {
 	It("ID format", func() {
 		// Unique ID format is "ttttt.rrrr" where "ttttt" is time in milliseconds since
@@ -571,3 +1877,24 @@ func readBodyData(cmd string) []byte {
 	Expect(err).Should(Succeed())
 	return getChunkDataByID(int32(id))
 }
+
+func readFrame(frame []byte) (string, uint32, []byte) {
+	Expect(len(frame)).Should(BeNumerically(">=", frameHeaderSize))
+	length := binary.BigEndian.Uint32(frame[8:])
+	Expect(frame).Should(HaveLen(frameHeaderSize + int(length)))
+	return string(frame[:4]), binary.BigEndian.Uint32(frame[4:]), frame[frameHeaderSize:]
+}
+
+func makeTestCertificate() string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).Should(Succeed())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).Should(Succeed())
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
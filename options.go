@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+/*
+ * Options that the caller may set on a handler using GoSetHandlerOption.
+ * Each request and response takes a copy of them when it is created, so
+ * changing an option only affects new requests.
+ */
+type handlerOptions struct {
+	// Send HADD, HSET and HDEL instead of WHDR when modifying headers
+	headerDeltas bool
+	// Largest number of request headers, or zero for no limit
+	maxHeaders int
+	// Largest size of the request line and headers, or zero for no limit
+	maxHeaderBytes int
+	// What to do with invalid characters in headers, URIs and variables
+	outputPolicy outputPolicy
+	// Return commands from GoPollRequestFrame instead of GoPollRequest
+	binaryFraming bool
+	// How many times the response phase may ask to retry a request
+	maxRetries int
+	// Start ERRR messages with the suggested HTTP status
+	errorStatus bool
+	// Response headers and trailers from the caller use the WHDR escapes
+	escapedHeaders bool
+}
+
+const (
+	optHeaderDeltas   = "headerDeltas"
+	optMaxHeaders     = "maxHeaders"
+	optMaxHeaderBytes = "maxHeaderBytes"
+	optOutputPolicy   = "outputPolicy"
+	optFraming        = "framing"
+	optMaxRetries     = "maxRetries"
+	optErrorStatus    = "errorStatus"
+	optEscapedHeaders = "escapedHeaders"
+
+	framingText   = "text"
+	framingBinary = "binary"
+
+	defaultMaxHeaders     = 100
+	defaultMaxHeaderBytes = http.DefaultMaxHeaderBytes
+	defaultMaxRetries     = 1
+)
+
+func defaultHandlerOptions() handlerOptions {
+	return handlerOptions{
+		maxHeaders:     defaultMaxHeaders,
+		maxHeaderBytes: defaultMaxHeaderBytes,
+		maxRetries:     defaultMaxRetries,
+	}
+}
+
+func (o *handlerOptions) set(name, value string) error {
+	switch name {
+	case optHeaderDeltas:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, value)
+		}
+		o.headerDeltas = b
+	case optErrorStatus:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, value)
+		}
+		o.errorStatus = b
+	case optEscapedHeaders:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, value)
+		}
+		o.escapedHeaders = b
+	case optMaxHeaders:
+		n, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, value)
+		}
+		o.maxHeaders = int(n)
+	case optMaxHeaderBytes:
+		n, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, value)
+		}
+		o.maxHeaderBytes = int(n)
+	case optOutputPolicy:
+		p, ok := parseOutputPolicy(value)
+		if !ok {
+			return fmt.Errorf("Invalid value for %s: %s", name, value)
+		}
+		o.outputPolicy = p
+	case optMaxRetries:
+		n, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, value)
+		}
+		o.maxRetries = int(n)
+	case optFraming:
+		switch value {
+		case framingText:
+			o.binaryFraming = false
+		case framingBinary:
+			o.binaryFraming = true
+		default:
+			return fmt.Errorf("Invalid value for %s: %s", name, value)
+		}
+	default:
+		return fmt.Errorf("Unknown handler option: %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+/*
+ * What to do when a pipeline produces a header, URI or status that the caller
+ * could not safely use, for instance because it contains a CR or LF that
+ * would let it inject headers of its own.
+ */
+type outputPolicy int
+
+const (
+	// Fail the request or response with ERRR
+	policyReject outputPolicy = iota
+	// Remove the characters that aren't allowed
+	policyStrip
+	// Replace the characters that aren't allowed with "%XX"
+	policyEncode
+)
+
+const (
+	policyRejectName = "reject"
+	policyStripName  = "strip"
+	policyEncodeName = "encode"
+)
+
+func parseOutputPolicy(s string) (outputPolicy, bool) {
+	switch s {
+	case policyRejectName:
+		return policyReject, true
+	case policyStripName:
+		return policyStrip, true
+	case policyEncodeName:
+		return policyEncode, true
+	default:
+		return policyReject, false
+	}
+}
+
+func isHeaderNameChar(c byte) bool {
+	return tokenChars[c]
+}
+
+/*
+ * Header values may contain tabs, but no other control characters.
+ */
+func isHeaderValueChar(c byte) bool {
+	return textChars[c] || c == '\t'
+}
+
+/*
+ * URIs may not contain spaces either.
+ */
+func isURIChar(c byte) bool {
+	return textChars[c] && c != ' '
+}
+
+/*
+ * Apply the policy to a single string. "what" describes the string in the
+ * error message.
+ */
+func (p outputPolicy) clean(what, s string, valid func(byte) bool) (string, error) {
+	bad := -1
+	for i := 0; i < len(s); i++ {
+		if !valid(s[i]) {
+			bad = i
+			break
+		}
+	}
+	if bad < 0 {
+		return s, nil
+	}
+
+	switch p {
+	case policyStrip, policyEncode:
+		buf := &bytes.Buffer{}
+		buf.WriteString(s[:bad])
+		for i := bad; i < len(s); i++ {
+			if valid(s[i]) {
+				buf.WriteByte(s[i])
+			} else if p == policyEncode {
+				fmt.Fprintf(buf, "%%%02X", s[i])
+			}
+		}
+		return buf.String(), nil
+	default:
+		return "", fmt.Errorf("Invalid character in %s: %q", what, s)
+	}
+}
+
+/*
+ * Apply the policy to a set of headers. If they are all fine, the same map
+ * is returned, and otherwise a copy. A header whose name is stripped away
+ * entirely is dropped.
+ */
+func (p outputPolicy) cleanHeaders(hdr http.Header) (http.Header, error) {
+	if headersValid(hdr) {
+		return hdr, nil
+	}
+
+	clean := http.Header{}
+	for name, vals := range hdr {
+		newName, err := p.clean("header name", name, isHeaderNameChar)
+		if err != nil {
+			return nil, err
+		}
+		if newName == "" {
+			continue
+		}
+		for _, v := range vals {
+			newVal, err := p.clean("header value", v, isHeaderValueChar)
+			if err != nil {
+				return nil, err
+			}
+			clean[newName] = append(clean[newName], newVal)
+		}
+	}
+	return clean, nil
+}
+
+func (p outputPolicy) cleanURI(uri string) (string, error) {
+	return p.clean("URI", uri, isURIChar)
+}
+
+func headersValid(hdr http.Header) bool {
+	for name, vals := range hdr {
+		if name == "" || !allValid(name, isHeaderNameChar) {
+			return false
+		}
+		for _, v := range vals {
+			if !allValid(v, isHeaderValueChar) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func allValid(s string, valid func(byte) bool) bool {
+	for i := 0; i < len(s); i++ {
+		if !valid(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Methods and status codes can't be cleaned up, so an invalid one is always
+ * an error.
+ */
+func checkMethod(method string) error {
+	if method == "" || !allValid(method, isHeaderNameChar) {
+		return fmt.Errorf("Invalid HTTP method: %q", method)
+	}
+	return nil
+}
+
+func checkStatus(status int) error {
+	if status < 100 || status > 999 {
+		return fmt.Errorf("Invalid HTTP status code: %d", status)
+	}
+	return nil
+}
@@ -3,18 +3,24 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 /*
  * This structure represents the proxy "response." If the code calls any
  * of these functions, then we "switch" and take over sending the
- * response. It matches the http.ResponseWriter interface.
+ * response, except for informational responses. It matches the
+ * http.ResponseWriter interface.
  */
 
 type httpResponse struct {
 	handler        commandHandler
+	policy         outputPolicy
 	headers        *http.Header
 	headersFlushed bool
+	trailerNames   []string
+	// Set if the output policy rejected the status, headers or trailers
+	err error
 }
 
 func (h *httpResponse) Header() http.Header {
@@ -35,32 +41,135 @@ func (h *httpResponse) Write(buf []byte) (int, error) {
 	// Flush ensures that headers are written only once and the first time
 	h.handler.ResponseWritten()
 	h.flush(http.StatusOK)
+	if h.err != nil {
+		return 0, h.err
+	}
 	sendBodyChunk(h.handler, buf)
 	return len(buf), nil
 }
 
 func (h *httpResponse) WriteHeader(status int) {
+	if isInformational(status) {
+		h.writeInformational(status)
+		return
+	}
 	h.handler.ResponseWritten()
 	h.flush(status)
 }
 
+/*
+ * 101 is the final response on an HTTP/1.1 connection, so it switches like
+ * any other status.
+ */
+func isInformational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+/*
+ * An informational response, such as 103 Early Hints, doesn't switch, so the
+ * pipeline may still write a final response or let the message through
+ * afterwards. It only carries the headers that the pipeline has set, since
+ * the others came from the message being handled. Like the standard
+ * ResponseWriter, those headers stay set for the final response, and it's
+ * too late for an informational response once the final one has started.
+ */
+func (h *httpResponse) writeInformational(status int) {
+	if h.headersFlushed || h.err != nil {
+		return
+	}
+	headers := http.Header{}
+	if h.headers != nil {
+		orig := h.handler.Headers()
+		for name, vals := range *h.headers {
+			if !stringsEqual(orig[name], vals) {
+				headers[name] = vals
+			}
+		}
+	}
+	headers, err := h.policy.cleanHeaders(headers)
+	if err != nil {
+		h.err = err
+		return
+	}
+	h.handler.SendCommand(command{
+		id:  WINF,
+		msg: fmt.Sprintf("%d\n%s", status, serializeHeaders(headers)),
+	})
+}
+
+/*
+ * Send the status and headers, unless they have already been sent. If
+ * they don't pass the output policy, then nothing is sent, and the error
+ * is saved so that the request fails when the pipeline is done.
+ */
 func (h *httpResponse) flush(status int) {
 	if h.headersFlushed {
 		return
 	}
+	h.headersFlushed = true
+
+	if err := checkStatus(status); err != nil {
+		h.err = err
+		return
+	}
+	var headers http.Header
+	if h.headers != nil {
+		var err error
+		headers, err = h.policy.cleanHeaders(*h.headers)
+		if err != nil {
+			h.err = err
+			return
+		}
+	}
+
 	swchCmd := command{
 		id:  SWCH,
 		msg: fmt.Sprintf("%d", status),
 	}
-	h.handler.Commands() <- swchCmd
+	h.handler.SendCommand(swchCmd)
 
-	if h.headers != nil {
+	if headers != nil {
+		for name := range declaredTrailers(headers) {
+			h.trailerNames = append(h.trailerNames, name)
+		}
 		whdrCmd := command{
 			id:  WHDR,
-			msg: serializeHeaders(*h.headers),
+			msg: serializeHeaders(headers),
 		}
-		h.handler.Commands() <- whdrCmd
+		h.handler.SendCommand(whdrCmd)
 	}
+}
 
-	h.headersFlushed = true
+/*
+ * Send the trailers at the end of the response. Just like the standard
+ * ResponseWriter, these are the headers that were announced in the "Trailer"
+ * header before the response was written, plus any headers whose names
+ * start with "http.TrailerPrefix."
+ */
+func (h *httpResponse) flushTrailers() {
+	if !h.headersFlushed || h.headers == nil || h.err != nil {
+		return
+	}
+	trailers := http.Header{}
+	for _, name := range h.trailerNames {
+		if vals := (*h.headers)[name]; len(vals) > 0 {
+			trailers[name] = vals
+		}
+	}
+	for name, vals := range *h.headers {
+		if strings.HasPrefix(name, http.TrailerPrefix) && len(vals) > 0 {
+			trailers[http.CanonicalHeaderKey(name[len(http.TrailerPrefix):])] = vals
+		}
+	}
+	trailers, err := h.policy.cleanHeaders(trailers)
+	if err != nil {
+		h.err = err
+		return
+	}
+	if len(trailers) > 0 {
+		h.handler.SendCommand(command{
+			id:  WTRL,
+			msg: serializeHeaders(trailers),
+		})
+	}
 }
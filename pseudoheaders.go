@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+ * An HTTP/2 or HTTP/3 frontend does not have a request line to pass to
+ * GoBeginRequest. Instead, it passes the pseudo-headers from the request,
+ * one per line at the start of the input, followed by the regular headers:
+ *
+ *   :method: GET
+ *   :scheme: https
+ *   :authority: example.com
+ *   :path: /foo
+ *
+ * There is no pseudo-header for the protocol version, so the request starts
+ * out as HTTP/2, and an HTTP/3 frontend says so using GoSetRequestHTTPVersion.
+ */
+
+type pseudoHeaders struct {
+	method    string
+	scheme    string
+	authority string
+	path      string
+	seen      map[string]bool
+}
+
+/*
+ * Headers that only make sense for a single HTTP/1.x connection, which
+ * must not appear in an HTTP/2 or HTTP/3 request.
+ */
+var connectionHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+func isPseudoHeaderLine(line string) bool {
+	return strings.HasPrefix(line, ":")
+}
+
+func (p *pseudoHeaders) parseLine(line string) error {
+	nlen := tokenLength(line[1:]) + 1
+	if nlen == 1 || nlen == len(line) || line[nlen] != ':' {
+		return fmt.Errorf("Invalid HTTP pseudo-header line: \"%s\"", line)
+	}
+	val, ok := headerValue(line[nlen+1:])
+	if !ok {
+		return fmt.Errorf("Invalid HTTP pseudo-header line: \"%s\"", line)
+	}
+
+	name := line[:nlen]
+	if p.seen[name] {
+		return fmt.Errorf("Duplicate HTTP pseudo-header: \"%s\"", name)
+	}
+	if p.seen == nil {
+		p.seen = make(map[string]bool)
+	}
+	p.seen[name] = true
+
+	switch name {
+	case ":method":
+		p.method = val
+	case ":scheme":
+		p.scheme = val
+	case ":authority":
+		p.authority = val
+	case ":path":
+		p.path = val
+	default:
+		return fmt.Errorf("Unknown HTTP pseudo-header: \"%s\"", name)
+	}
+	return nil
+}
+
+/*
+ * Fill in the parts of the request that come from the pseudo-headers, using
+ * the same rules as RFC 7540. A CONNECT request only has an authority, and
+ * every other request must have a scheme and a path.
+ */
+func (p *pseudoHeaders) apply(req *http.Request) error {
+	if p.method == "" || tokenLength(p.method) != len(p.method) {
+		return fmt.Errorf("Invalid HTTP pseudo-header \":method\": \"%s\"", p.method)
+	}
+
+	req.Proto = "HTTP/2.0"
+	req.ProtoMajor = 2
+	req.ProtoMinor = 0
+
+	if p.method == "CONNECT" {
+		if p.authority == "" || p.seen[":scheme"] || p.seen[":path"] {
+			return fmt.Errorf("Invalid HTTP pseudo-headers for CONNECT")
+		}
+		req.URL = &url.URL{Host: p.authority}
+		req.RequestURI = p.authority
+	} else {
+		if p.scheme == "" || p.path == "" {
+			return fmt.Errorf("Missing HTTP pseudo-header \":scheme\" or \":path\"")
+		}
+		u, err := url.ParseRequestURI(p.path)
+		if err != nil {
+			return err
+		}
+		u.Scheme = p.scheme
+		u.Host = p.authority
+		req.URL = u
+		req.RequestURI = p.path
+	}
+
+	req.Method = p.method
+	return checkConnectionHeaders(req.Header)
+}
+
+/*
+ * Requests that came with pseudo-headers may be HTTP/2 or HTTP/3.
+ */
+func isPseudoHeaderVersion(major int) bool {
+	return major == 2 || major == 3
+}
+
+func setPseudoHeaderVersion(req *http.Request, major int) {
+	if req.ProtoMajor < 2 {
+		// There was a request line, which already has the version.
+		return
+	}
+	req.Proto = fmt.Sprintf("HTTP/%d.0", major)
+	req.ProtoMajor = major
+}
+
+func checkConnectionHeaders(hdr http.Header) error {
+	for key := range hdr {
+		if connectionHeaders[key] {
+			return fmt.Errorf("Connection-specific header not allowed: \"%s\"", key)
+		}
+	}
+	for _, te := range hdr["Te"] {
+		if !strings.EqualFold(te, "trailers") {
+			return fmt.Errorf("Invalid value for header \"Te\": \"%s\"", te)
+		}
+	}
+	return nil
+}
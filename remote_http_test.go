@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -44,6 +46,19 @@ var _ = Describe("Remote HTTP Tests", func() {
 		Expect(bytes.Equal(body, readBody)).Should(BeTrue())
 	})
 
+	It("Read trailers POST", func() {
+		// Wrapping the buffer hides its length, so the body is chunked.
+		body := ioutil.NopCloser(bytes.NewBufferString("Hello, World!"))
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/readtrailers", testURL), body)
+		Expect(err).Should(Succeed())
+		req.Trailer = http.Header{"X-Checksum": []string{"1234"}}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(lastTestTrailers.Get("X-Checksum")).Should(Equal("1234"))
+	})
+
 	It("Discard body POST", func() {
 		body := []byte("Hello, World!")
 		bodyBuf := bytes.NewBuffer(body)
@@ -100,6 +115,63 @@ var _ = Describe("Remote HTTP Tests", func() {
 		Expect(resp.StatusCode).Should(Equal(201))
 	})
 
+	It("Internal redirect GET", func() {
+		resp, err := http.Get(fmt.Sprintf("%s/redirectrequest", testURL))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(201))
+	})
+
+	It("Internal redirect from response GET", func() {
+		resp, err := http.Get(fmt.Sprintf("%s/redirectresponse", testURL))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(201))
+		Expect(resp.Header.Get("X-Ignored")).Should(BeEmpty())
+	})
+
+	It("Retry GET", func() {
+		resp, err := http.Get(fmt.Sprintf("%s/retryonce", testURL))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(resp.Header.Get("X-Retried")).Should(Equal("yes"))
+	})
+
+	It("Complete transaction GET", func() {
+		resp, err := http.Get(fmt.Sprintf("%s/logtransaction", testURL))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+
+		var result testTransaction
+		Eventually(testTransactions).Should(Receive(&result))
+		Expect(result.stats.Status).Should(Equal(200))
+		Expect(result.stats.UpstreamTime).Should(BeNumerically("<", 0))
+		Expect(result.stats.RequestTime).Should(BeNumerically(">", 0))
+		Expect(result.responseStatus).Should(Equal(200))
+	})
+
+	It("Early hints GET", func() {
+		var hints []string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, hdr textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, hdr.Get("Link"))
+				}
+				return nil
+			},
+		}
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/earlyhints", testURL), nil)
+		Expect(err).Should(Succeed())
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(hints).Should(Equal([]string{"</style.css>; rel=preload; as=style"}))
+	})
+
 	It("Return Headers GET", func() {
 		resp, err := http.Get(fmt.Sprintf("%s/returnheaders", testURL))
 		Expect(err).Should(Succeed())
@@ -118,6 +190,27 @@ var _ = Describe("Remote HTTP Tests", func() {
 		Expect(bytes.Equal(expectedBody, body)).Should(BeTrue())
 	})
 
+	It("Return Trailers GET", func() {
+		resp, err := http.Get(fmt.Sprintf("%s/returntrailers", testURL))
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		_, err = ioutil.ReadAll(resp.Body)
+		Expect(err).Should(Succeed())
+		Expect(resp.Trailer.Get("Grpc-Status")).Should(Equal("0"))
+		Expect(resp.Trailer.Get("Grpc-Message")).Should(Equal("OK"))
+	})
+
+	It("Return remote address GET", func() {
+		resp, err := http.Get(fmt.Sprintf("%s/returnremoteaddr", testURL))
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).Should(Succeed())
+		Expect(string(body)).Should(MatchRegexp("^(127\\.0\\.0\\.1|\\[::1\\]):[0-9]+$"))
+	})
+
 	It("Return MessageID GET", func() {
 		resp, err := http.Get(fmt.Sprintf("%s/replacewithid", testURL))
 		Expect(err).Should(Succeed())
@@ -5,9 +5,10 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"reflect"
+	"sync"
 
 	"github.com/30x/gozerian/pipeline"
+	"github.com/30x/libgozerian/weaver"
 )
 
 /*
@@ -22,8 +23,9 @@ const (
 /*
  * This represents a single request. The request, in turn, drives HTTP.
  * It is assumed that all function calls for a single request happen in the same
- * goroutine (that will be the case for an Nginx worker). However, request
- * processing itself may happen in a different goroutine.
+ * goroutine (that will be the case for an Nginx worker). The pipeline runs in
+ * that goroutine too if it can never need anything from the caller. Otherwise
+ * it runs in a goroutine of its own.
  */
 
 const (
@@ -32,31 +34,88 @@ const (
 )
 
 type request struct {
-	req         *http.Request
-	resp        *httpResponse
-	origHeaders http.Header
-	origURL     *url.URL
-	origBody    io.ReadCloser
-	id          uint32
-	msgID       string
-	pipe        pipeline.Pipe
-	pd          pipeline.Definition
-	cmds        chan command
-	bodies      chan []byte
-	proxying    bool
-}
-
-func newRequest(id uint32, pd pipeline.Definition) *request {
+	req          *http.Request
+	resp         *httpResponse
+	origHeaders  http.Header
+	origFields   headerList
+	origMethod   string
+	origURL      *url.URL
+	origHost     string
+	scheme       string
+	httpVersion  int
+	conn         *connectionInfo
+	vars         *variables
+	host         *requestHost
+	upstream     string
+	redirect     string
+	retries      int
+	origBody     io.ReadCloser
+	origTrailers http.Header
+	trailers     http.Header
+	id           uint32
+	msgID        string
+	pipe         pipeline.Pipe
+	pd           pipeline.Definition
+	options      handlerOptions
+	cmds         chan command
+	bodies       chan []byte
+	yielded      chan bool
+	proxying     bool
+	flushed      bool
+	// Commands from a pipeline that is running inline, how many of them
+	// have been polled, and whether the transaction is complete, protected
+	// by latch
+	latch     sync.Mutex
+	inline    bool
+	pending   []command
+	polled    int
+	completed bool
+}
+
+func newRequest(id uint32, pd pipeline.Definition, options handlerOptions) *request {
 	r := request{
 		id:       id,
 		proxying: true,
 		pd:       pd,
+		options:  options,
 	}
+	r.vars = newVariables(&r, options.outputPolicy)
+	r.host = &requestHost{variables: r.vars, req: &r}
 	return &r
 }
 
-func (r *request) Commands() chan command {
-	return r.cmds
+/*
+ * Set the scheme that the request arrived with, which is not part of an
+ * origin-form request target. It must be set before the request begins.
+ * Otherwise, it depends on whether the connection uses TLS.
+ */
+func (r *request) setScheme(scheme string) {
+	r.scheme = scheme
+}
+
+func (r *request) setHTTPVersion(major int) {
+	r.httpVersion = major
+}
+
+func (r *request) setConnectionInfo(conn *connectionInfo) {
+	r.conn = conn
+}
+
+func (r *request) SendCommand(cmd command) {
+	if r.sendInline(cmd) {
+		return
+	}
+	select {
+	case r.cmds <- cmd:
+	default:
+		// The queue is full, so the caller has to start polling before
+		// the pipeline can make any more progress.
+		r.yield()
+		r.cmds <- cmd
+	}
+	if cmd.id.needsCaller() {
+		r.yield()
+	}
 }
 
 func (r *request) Bodies() chan []byte {
@@ -74,45 +133,158 @@ func (r *request) ResponseWritten() {
 func (r *request) StartRead() {
 }
 
+func (r *request) SetTrailers(trailers http.Header) {
+	r.trailers = trailers
+}
+
+func (r *request) SetRedirect(location string) error {
+	if r.flushed {
+		return errRequestSent
+	}
+	r.redirect = location
+	return nil
+}
+
+func (r *request) EndRead() {
+	mergeTrailers(r.req.Trailer, r.trailers)
+	// Trailers that came from the caller don't need to be sent back.
+	r.origTrailers = copyHeaders(r.req.Trailer)
+}
+
+/*
+ * Start the request, and do not return until the pipeline has either finished
+ * or needs something from the caller. A pipeline that has declared that it
+ * never reads the body or makes subrequests can't need anything, so it runs
+ * right here, and every command it produced is waiting to be polled by the
+ * time we return. Any other pipeline gets a goroutine of its own.
+ */
 func (r *request) begin(rawHeaders string) error {
 	r.cmds = make(chan command, commandQueueSize)
 	r.bodies = make(chan []byte, bodyQueueSize)
+	if canRunInline(capabilitiesOf(r.pd)) {
+		r.runInline(rawHeaders)
+		return nil
+	}
+
+	r.yielded = make(chan bool, 1)
 	go r.startRequest(rawHeaders)
+	<-r.yielded
 	return nil
 }
 
-func (r *request) pollNB() string {
+func canRunInline(caps Capability) bool {
+	return !caps.has(RequestBody) && !caps.has(Subrequests)
+}
+
+func (r *request) runInline(rawHeaders string) {
+	r.setInline(true)
+	defer r.setInline(false)
+	r.startRequest(rawHeaders)
+}
+
+func (r *request) setInline(inline bool) {
+	r.latch.Lock()
+	r.inline = inline
+	r.latch.Unlock()
+}
+
+/*
+ * Nothing polls until an inline pipeline returns, so its commands wait in a
+ * slice instead of the channel, where they could fill the queue. The pipeline
+ * may send them from goroutines of its own, which may still be running
+ * afterwards. Those commands go to the channel as usual.
+ */
+func (r *request) sendInline(cmd command) bool {
+	r.latch.Lock()
+	defer r.latch.Unlock()
+	if !r.inline {
+		return false
+	}
+	r.pending = append(r.pending, cmd)
+	return true
+}
+
+/*
+ * Let "begin" return to the caller. This may be called more than once, but
+ * only the first call has any effect.
+ */
+func (r *request) yield() {
+	select {
+	case r.yielded <- true:
+	default:
+	}
+}
+
+/*
+ * Return the next command, if there is one. If "block" is set, wait for
+ * one instead.
+ */
+func (r *request) poll(block bool) (command, bool) {
+	if cmd, ok := r.pollInline(); ok {
+		return cmd, true
+	}
+	if block {
+		return <-r.cmds, true
+	}
 	select {
 	case cmd := <-r.cmds:
-		return cmd.String()
+		return cmd, true
 	default:
-		return ""
+		return command{}, false
 	}
 }
 
-func (r *request) poll() string {
-	cmd := <-r.cmds
-	return cmd.String()
+func (r *request) pollInline() (command, bool) {
+	r.latch.Lock()
+	defer r.latch.Unlock()
+	if r.polled < len(r.pending) {
+		cmd := r.pending[r.polled]
+		r.polled++
+		return cmd, true
+	}
+	return command{}, false
 }
 
 func (r *request) startRequest(rawHeaders string) {
-	req, err := parseHTTPHeaders(rawHeaders, true)
+	req, fields, err := r.parseRequest(rawHeaders)
 	if err != nil {
-		r.cmds <- createErrorCommand(err)
+		r.SendCommand(createErrorCommand(err, r.options.errorStatus))
 		return
 	}
+	if r.httpVersion != 0 {
+		setPseudoHeaderVersion(req, r.httpVersion)
+	}
+	if r.conn != nil {
+		req = r.conn.apply(req)
+	}
+	req = req.WithContext(weaver.NewContext(req.Context(), r.host))
+	scheme := r.scheme
+	if scheme == "" {
+		scheme = r.conn.scheme()
+	}
+
 	// Save headers for later
 	r.origHeaders = copyHeaders(req.Header)
-	r.origURL = req.URL
+	r.origFields = fields
+	r.origMethod = req.Method
+	r.origHost = req.Host
+	completeRequestURL(req, scheme)
+	// Copy the URL, because the pipeline may change it in place.
+	origURL := *req.URL
+	r.origURL = &origURL
+	req.Trailer = declaredTrailers(req.Header)
+	r.origTrailers = copyHeaders(req.Trailer)
 	r.req = req
 
 	resp := &httpResponse{
 		handler: r,
+		policy:  r.options.outputPolicy,
 	}
 	r.resp = resp
 
 	req.Body = &requestBody{
-		handler: r,
+		handler:    r,
+		undeclared: !capabilitiesOf(r.pd).has(RequestBody),
 	}
 	r.origBody = req.Body
 
@@ -124,14 +296,48 @@ func (r *request) startRequest(rawHeaders string) {
 	r.pipe.RequestHandlerFunc()(resp, req)
 
 	// It's possible that not everything was cleaned up here.
+	r.flushed = true
 	if r.proxying {
-		r.flush()
+		err = r.flush()
 	} else {
 		r.resp.flush(http.StatusOK)
+		r.resp.flushTrailers()
+		err = r.resp.err
+	}
+	if err != nil {
+		// The pipeline produced something that the caller can't use.
+		r.SendCommand(createErrorCommand(err, r.options.errorStatus))
+		return
+	}
+	if r.proxying && r.redirect != "" {
+		// Everything else still applies to the request at the new location.
+		r.SendCommand(command{
+			id:  IRDR,
+			msg: r.redirect,
+		})
 	}
 
 	// This signals that everything is done.
-	r.cmds <- command{id: DONE}
+	r.SendCommand(command{id: DONE})
+}
+
+/*
+ * Parse the request line and headers, and enforce the limits for the
+ * handler. Everything that goes wrong here is the client's fault.
+ */
+func (r *request) parseRequest(rawHeaders string) (*http.Request, headerList, error) {
+	max := r.options.maxHeaderBytes
+	if max > 0 && len(rawHeaders) > max {
+		return nil, nil, &httpError{
+			status: http.StatusRequestHeaderFieldsTooLarge,
+			err:    fmt.Errorf("Request headers are longer than %d bytes", max),
+		}
+	}
+	req, fields, err := parseHTTPHeaderList(rawHeaders, true, r.options.maxHeaders)
+	if err != nil {
+		return nil, nil, withStatus(http.StatusBadRequest, err)
+	}
+	return req, fields, nil
 }
 
 func readAndSend(handler commandHandler, body io.ReadCloser) {
@@ -152,10 +358,11 @@ func sendBodyChunk(handler commandHandler, chunk []byte) {
 	chunkID := allocateChunk(chunk)
 
 	cmd := command{
-		id:  WBOD,
-		msg: fmt.Sprintf("%x", chunkID),
+		id:      WBOD,
+		msg:     fmt.Sprintf("%x", chunkID),
+		chunkID: chunkID,
 	}
-	handler.Commands() <- cmd
+	handler.SendCommand(cmd)
 }
 
 func allocateChunk(chunk []byte) int32 {
@@ -166,24 +373,47 @@ func allocateChunk(chunk []byte) int32 {
 	return chunkID
 }
 
-func (r *request) flush() {
+func (r *request) flush() error {
+	policy := r.options.outputPolicy
+	if r.upstream != "" {
+		r.SendCommand(command{
+			id:  WTGT,
+			msg: r.upstream,
+		})
+	}
+	if r.origMethod != r.req.Method {
+		if err := checkMethod(r.req.Method); err != nil {
+			return err
+		}
+		r.SendCommand(command{
+			id:  WMTH,
+			msg: r.req.Method,
+		})
+	}
 	if r.origURL.String() != r.req.URL.String() {
+		target, err := policy.cleanURI(rewrittenTarget(r.req.Method, r.origURL, r.req.URL))
+		if err != nil {
+			return err
+		}
 		uriCmd := command{
 			id:  WURI,
-			msg: r.req.URL.String(),
+			msg: target,
 		}
-		r.cmds <- uriCmd
+		r.SendCommand(uriCmd)
 	}
-	if !reflect.DeepEqual(r.origHeaders, r.req.Header) {
-		hdrCmd := command{
-			id:  WHDR,
-			msg: serializeHeaders(r.req.Header),
-		}
-		r.cmds <- hdrCmd
+	if r.req.Host != r.origHost {
+		// Like the standard HTTP client, "Host" wins over the header.
+		r.req.Header.Set("Host", r.req.Host)
+	}
+	err := sendHeaderChanges(r, r.options.headerDeltas, policy,
+		r.origFields, r.origHeaders, r.req.Header)
+	if err != nil {
+		return err
 	}
 	if r.req.Body != r.origBody {
 		readAndSend(r, r.req.Body)
 	}
+	return sendTrailerChanges(r, policy, r.origTrailers, r.req.Trailer)
 }
 
 func copyHeaders(hdr http.Header) http.Header {
@@ -1,37 +1,51 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"net/http"
-	"reflect"
-	"strconv"
 
 	"github.com/30x/gozerian/pipeline"
+	"github.com/30x/libgozerian/weaver"
 )
 
 type response struct {
-	id          uint32
-	cmds        chan command
-	bodies      chan []byte
-	resp        *http.Response
-	request     *request
-	origStatus  int
-	origHeaders http.Header
-	origBody    io.Reader
-	readStarted bool
-}
-
-func newResponse(id uint32, pd pipeline.Definition) *response {
+	id           uint32
+	cmds         chan command
+	bodies       chan []byte
+	resp         *http.Response
+	request      *request
+	origStatus   int
+	origReason   string
+	origHeaders  http.Header
+	origFields   headerList
+	origBody     io.Reader
+	origTrailers http.Header
+	trailers     http.Header
+	options      handlerOptions
+	readStarted  bool
+	written      bool
+	redirect     string
+	retrying     bool
+	retryTarget  string
+	// Set if the caller never got a response from the upstream server
+	failure *weaver.UpstreamError
+	// Set if the output policy rejected the status or headers
+	err error
+}
+
+func newResponse(id uint32, pd pipeline.Definition, options handlerOptions) *response {
 	r := response{
-		id:     id,
-		cmds:   make(chan command, commandQueueSize),
-		bodies: make(chan []byte, bodyQueueSize),
+		id:      id,
+		cmds:    make(chan command, commandQueueSize),
+		bodies:  make(chan []byte, bodyQueueSize),
+		options: options,
 	}
 	return &r
 }
 
-func (r *response) Commands() chan command {
-	return r.cmds
+func (r *response) SendCommand(cmd command) {
+	r.cmds <- cmd
 }
 
 func (r *response) Bodies() chan []byte {
@@ -43,6 +57,7 @@ func (r *response) Headers() http.Header {
 }
 
 func (r *response) ResponseWritten() {
+	r.written = true
 }
 
 func (r *response) StartRead() {
@@ -50,75 +65,179 @@ func (r *response) StartRead() {
 	// This limitation may be specific to nginx -- if so then we will make it
 	// configurable.
 	r.readStarted = true
-	r.flushHeaders()
+	r.err = r.flushHeaders()
+}
+
+func (r *response) SetTrailers(trailers http.Header) {
+	r.trailers = trailers
+}
+
+func (r *response) SetRedirect(location string) error {
+	// The caller may already have passed part of the response on.
+	if r.written || r.readStarted {
+		return errResponseSent
+	}
+	r.redirect = location
+	return nil
+}
+
+func (r *response) EndRead() {
+	mergeTrailers(r.resp.Trailer, r.trailers)
+	r.origTrailers = copyHeaders(r.resp.Trailer)
 }
 
 func (r *response) begin(status uint32, rawHeaders string, req *request) error {
 	r.request = req
+	req.vars.setHandler(r)
 	go r.startResponse(status, rawHeaders)
 	return nil
 }
 
-func (r *response) pollNB() string {
+/*
+ * Return the next command, if there is one. If "block" is set, wait for
+ * one instead.
+ */
+func (r *response) poll(block bool) (command, bool) {
+	if block {
+		return <-r.cmds, true
+	}
 	select {
 	case cmd := <-r.cmds:
-		return cmd.String()
+		return cmd, true
 	default:
-		return ""
+		return command{}, false
 	}
 }
 
-func (r *response) poll() string {
-	cmd := <-r.cmds
-	return cmd.String()
+func (r *response) startResponse(status uint32, rawHeaders string) {
+	resp, fields, err := parseHTTPResponse(status, rawHeaders, r.options.escapedHeaders)
+	if err != nil {
+		// The upstream server sent something that we can't understand.
+		r.SendCommand(createErrorCommand(withStatus(http.StatusBadGateway, err), r.options.errorStatus))
+		return
+	}
+	resp.Body = &requestBody{
+		handler:    r,
+		undeclared: !capabilitiesOf(r.request.pd).has(ResponseBody),
+	}
+	r.runResponse(resp, fields)
 }
 
-func (r *response) startResponse(status uint32, rawHeaders string) {
-	resp, err := parseHTTPResponse(status, rawHeaders)
+/*
+ * When the caller couldn't get a response from the upstream server at all,
+ * the pipeline sees an empty response with a 502 or 504 status instead. It
+ * can tell the difference using weaver.UpstreamFailure.
+ */
+func (r *response) beginUpstreamError(failure *weaver.UpstreamError, req *request) error {
+	status := upstreamErrorStatus(failure.Kind)
+	if status == 0 {
+		return fmt.Errorf("Unknown upstream error kind: %d", failure.Kind)
+	}
+	r.request = req
+	r.failure = failure
+	req.vars.setHandler(r)
+	go r.startUpstreamError(status)
+	return nil
+}
+
+func (r *response) startUpstreamError(status int) {
+	resp, fields, err := parseHTTPResponse(uint32(status), "", false)
 	if err != nil {
-		r.cmds <- createErrorCommand(err)
+		r.SendCommand(createErrorCommand(err, r.options.errorStatus))
 		return
 	}
+	resp.Body = http.NoBody
+	resp.ContentLength = 0
+	r.runResponse(resp, fields)
+}
+
+func upstreamErrorStatus(kind weaver.UpstreamErrorKind) int {
+	switch kind {
+	case weaver.UpstreamUnreachable, weaver.UpstreamInvalidResponse:
+		return http.StatusBadGateway
+	case weaver.UpstreamTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return 0
+	}
+}
 
+func (r *response) runResponse(resp *http.Response, fields headerList) {
 	resp.Request = r.request.req
 	r.resp = resp
 	r.origStatus = resp.StatusCode
+	r.origReason = statusReason(resp)
 	r.origHeaders = copyHeaders(resp.Header)
-
-	resp.Body = &requestBody{
-		handler: r,
-	}
+	r.origFields = fields
+	resp.Trailer = declaredTrailers(resp.Header)
+	r.origTrailers = copyHeaders(resp.Trailer)
 	r.origBody = resp.Body
 
 	rresp := &httpResponse{
 		handler: r,
+		policy:  r.options.outputPolicy,
 	}
 
 	r.request.pipe.ResponseHandlerFunc()(rresp, resp.Request, resp)
 
+	if r.retrying && r.err == nil {
+		// Like a redirect, the response is going to be thrown away.
+		r.SendCommand(command{
+			id:  RTRY,
+			msg: r.retryTarget,
+		})
+		r.SendCommand(command{id: DONE})
+		return
+	}
+	if r.redirect != "" && r.err == nil {
+		// The response is going to be thrown away, so there's no point in
+		// sending anything else.
+		r.SendCommand(command{
+			id:  IRDR,
+			msg: r.redirect,
+		})
+		r.SendCommand(command{id: DONE})
+		return
+	}
 	if !r.readStarted {
-		r.flushHeaders()
+		r.err = r.flushHeaders()
+	}
+	if r.err == nil {
+		r.flushBody()
+		if rresp.headersFlushed {
+			rresp.flushTrailers()
+			r.err = rresp.err
+		} else {
+			r.err = sendTrailerChanges(r, r.options.outputPolicy, r.origTrailers, r.resp.Trailer)
+		}
+	}
+	if r.err != nil {
+		r.SendCommand(createErrorCommand(r.err, r.options.errorStatus))
+		return
 	}
-	r.flushBody()
 
-	r.cmds <- command{id: DONE}
+	r.SendCommand(command{id: DONE})
 }
 
-func (r *response) flushHeaders() {
-	if r.origStatus != r.resp.StatusCode {
+func (r *response) flushHeaders() error {
+	policy := r.options.outputPolicy
+	reason := statusReason(r.resp)
+	if r.origStatus != r.resp.StatusCode || r.origReason != reason {
+		if err := checkStatus(r.resp.StatusCode); err != nil {
+			return err
+		}
+		reason, err := policy.clean("status reason", reason, isHeaderValueChar)
+		if err != nil {
+			return err
+		}
 		staCmd := command{
 			id:  WSTA,
-			msg: strconv.Itoa(r.resp.StatusCode),
-		}
-		r.cmds <- staCmd
-	}
-	if !reflect.DeepEqual(r.origHeaders, r.resp.Header) {
-		hdrCmd := command{
-			id:  WHDR,
-			msg: serializeHeaders(r.resp.Header),
+			msg: formatStatus(r.resp.StatusCode, reason),
 		}
-		r.cmds <- hdrCmd
+		r.SendCommand(staCmd)
 	}
+	return sendHeaderChanges(r, r.options.headerDeltas, policy,
+		r.origFields, r.origHeaders, r.resp.Header)
 }
 
 func (r *response) flushBody() {
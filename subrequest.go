@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * A pipeline may ask the caller to make an HTTP request on its behalf, for
+ * instance to check credentials with another service. The caller gets a SUBR
+ * command, makes the request however it likes, and passes the response back
+ * using the subrequest ID from the command. Meanwhile the pipeline waits.
+ */
+
+type subrequestResult struct {
+	resp *http.Response
+	err  error
+}
+
+// A subrequest that is waiting for the caller, and the request that made it
+type pendingSubrequest struct {
+	results chan subrequestResult
+	req     *request
+}
+
+// Subrequests that are waiting for the caller, protected by managerLatch
+var subrequests = make(map[uint32]*pendingSubrequest)
+
+var errSubrequestsNotSupported = errors.New("Subrequests are not supported here")
+var errRequestFreed = errors.New("Request was freed before the subrequest finished")
+
+/*
+ * Send the request to the caller and wait for the response. This makes the
+ * host an http.RoundTripper.
+ */
+func (h *requestHost) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !capabilitiesOf(h.req.pd).has(Subrequests) {
+		// The pipeline may be running inline, so nobody would see the SUBR.
+		return nil, errSubrequestsNotDeclared
+	}
+	cmd, id, err := makeSubrequestCommand(req)
+	if err != nil {
+		return nil, err
+	}
+	results := make(chan subrequestResult, 1)
+	managerLatch.Lock()
+	subrequests[id] = &pendingSubrequest{results: results, req: h.req}
+	managerLatch.Unlock()
+	defer finishSubrequest(id)
+
+	h.currentHandler().SendCommand(cmd)
+
+	select {
+	case result := <-results:
+		if result.resp != nil {
+			result.resp.Request = req
+		}
+		return result.resp, result.err
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+/*
+ * The first line of a SUBR message is the subrequest ID in hex, the method,
+ * the URI, and, if there is a body, the ID of the chunk that holds it. The
+ * rest of the message is the headers, in the WHDR format.
+ */
+func makeSubrequestCommand(req *http.Request) (command, uint32, error) {
+	if err := checkMethod(req.Method); err != nil {
+		return command{}, 0, err
+	}
+	uri := req.URL.String()
+	if req.URL.Host == "" {
+		uri = req.URL.RequestURI()
+	}
+	uri, err := policyReject.cleanURI(uri)
+	if err != nil {
+		return command{}, 0, err
+	}
+	hdrs := req.Header
+	if req.Host != "" {
+		hdrs = copyHeaders(req.Header)
+		hdrs.Set("Host", req.Host)
+	}
+	hdrs, err = policyReject.cleanHeaders(hdrs)
+	if err != nil {
+		return command{}, 0, err
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return command{}, 0, err
+		}
+	}
+
+	managerLatch.Lock()
+	lastID++
+	id := lastID
+	managerLatch.Unlock()
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%x %s %s", id, req.Method, uri)
+	if len(body) > 0 {
+		fmt.Fprintf(buf, " %x", allocateChunk(body))
+	}
+	buf.WriteByte('\n')
+	buf.WriteString(serializeHeaders(hdrs))
+	return command{id: SUBR, msg: buf.String()}, id, nil
+}
+
+/*
+ * Fail a subrequest from a SUBR message that nobody is going to make, and
+ * free the chunk with its body.
+ */
+func rejectSubrequest(msg string, err error) {
+	line := msg
+	if end := strings.IndexByte(msg, '\n'); end >= 0 {
+		line = msg[:end]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	if len(fields) > 3 {
+		takeChunk(fields[3])
+	}
+	id, _ := strconv.ParseUint(fields[0], 16, 32)
+	failSubrequest(uint32(id), err.Error())
+}
+
+func finishSubrequest(id uint32) {
+	managerLatch.Lock()
+	delete(subrequests, id)
+	managerLatch.Unlock()
+}
+
+func takeSubrequest(id uint32) (*pendingSubrequest, error) {
+	managerLatch.Lock()
+	sub := subrequests[id]
+	delete(subrequests, id)
+	managerLatch.Unlock()
+
+	if sub == nil {
+		return nil, fmt.Errorf("Unknown subrequest: %d", id)
+	}
+	return sub, nil
+}
+
+func completeSubrequest(id uint32, result subrequestResult) error {
+	sub, err := takeSubrequest(id)
+	if err != nil {
+		return err
+	}
+	sub.results <- result
+	return nil
+}
+
+/*
+ * Deliver the response to a subrequest. The status and headers are in the
+ * same format as for GoBeginResponse, and the whole body is here.
+ */
+func sendSubrequestResponse(id, status uint32, rawHeaders string, body []byte) error {
+	sub, err := takeSubrequest(id)
+	if err != nil {
+		return err
+	}
+	resp, _, err := parseHTTPResponse(status, rawHeaders, sub.req.options.escapedHeaders)
+	if err != nil {
+		sub.results <- subrequestResult{err: err}
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	sub.results <- subrequestResult{resp: resp}
+	return nil
+}
+
+/*
+ * Fail every subrequest that the request is still waiting for. Otherwise,
+ * a pipeline whose caller freed the request without answering a SUBR would
+ * wait forever.
+ */
+func failSubrequestsOf(req *request) {
+	var pending []*pendingSubrequest
+	managerLatch.Lock()
+	for id, sub := range subrequests {
+		if sub.req == req {
+			pending = append(pending, sub)
+			delete(subrequests, id)
+		}
+	}
+	managerLatch.Unlock()
+
+	for _, sub := range pending {
+		sub.results <- subrequestResult{err: errRequestFreed}
+	}
+}
+
+func failSubrequest(id uint32, msg string) error {
+	return completeSubrequest(id, subrequestResult{err: errors.New(msg)})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+/*
+ * This is the one-shot API for hosts that would rather not drive the
+ * command protocol themselves. Each phase is run to completion and all
+ * the commands that it produced are folded into a single result.
+ */
+
+type syncResult struct {
+	requestID     uint32
+	err           string
+	switched      bool
+	status        int
+	reason        string
+	method        string
+	uri           string
+	upstream      string
+	headers       string
+	headersSet    bool
+	trailers      string
+	trailersSet   bool
+	body          []byte
+	bodyChanged   bool
+	logs          []string
+	variables     []string
+	redirect      string
+	retry         bool
+	informational []string
+}
+
+/*
+ * Run the request phase all at once. The request is not freed, because it
+ * is needed for the response phase. The caller must free it using the
+ * request ID in the result.
+ */
+func processRequestSync(handlerID, rawHeaders string, body []byte) *syncResult {
+	id := createRequest(handlerID)
+	if id == 0 {
+		return &syncResult{
+			err: fmt.Sprintf("Unknown handler: %s", handlerID),
+		}
+	}
+
+	req := getRequest(id)
+	// The result only has room for a complete set of headers, and it has a
+	// field of its own for the status of an error.
+	req.options.headerDeltas = false
+	req.options.errorStatus = true
+	req.begin(rawHeaders)
+	result := collectSync(req.poll, func() {
+		sendRequestBodyChunk(id, true, body)
+	})
+	result.requestID = id
+	return result
+}
+
+/*
+ * Run the response phase all at once, using a request that was already
+ * processed, either with "processRequestSync" or by the usual calls.
+ */
+func processResponseSync(handlerID string, requestID, status uint32, rawHeaders string, body []byte) *syncResult {
+	id := createResponse(handlerID)
+	if id == 0 {
+		return &syncResult{
+			requestID: requestID,
+			err:       fmt.Sprintf("Unknown handler: %s", handlerID),
+		}
+	}
+	defer freeResponse(id)
+	resp := getResponse(id)
+	resp.options.headerDeltas = false
+	resp.options.errorStatus = true
+
+	err := beginResponse(id, requestID, status, rawHeaders)
+	if err != nil {
+		return &syncResult{
+			requestID: requestID,
+			err:       err.Error(),
+		}
+	}
+	result := collectSync(getResponse(id).poll, func() {
+		sendResponseBodyChunk(id, true, body)
+	})
+	result.requestID = requestID
+	return result
+}
+
+func collectSync(poll func(bool) (command, bool), sendBody func()) *syncResult {
+	result := &syncResult{}
+	bodySent := false
+	for {
+		cmd, _ := poll(true)
+		switch cmd.id {
+		case DONE:
+			return result
+		case ERRR:
+			result.status, result.err = parseErrorMessage(cmd.msg)
+			return result
+		case RBOD:
+			// The whole body is sent in response to the first RBOD.
+			if !bodySent {
+				sendBody()
+				bodySent = true
+			}
+		case SUBR:
+			// There's nobody to make the request.
+			rejectSubrequest(cmd.msg, errSubrequestsNotSupported)
+		case WLOG:
+			result.logs = append(result.logs, cmd.msg)
+		case WVAR:
+			result.variables = append(result.variables, cmd.msg)
+		case WINF:
+			result.informational = append(result.informational, cmd.msg)
+		case RTRY:
+			result.retry = true
+			result.upstream = cmd.msg
+		case IRDR:
+			result.redirect = cmd.msg
+		case WTGT:
+			result.upstream = cmd.msg
+		case WMTH:
+			result.method = cmd.msg
+		case WURI:
+			result.uri = cmd.msg
+		case WHDR:
+			result.headers = cmd.msg
+			result.headersSet = true
+		case WTRL:
+			result.trailers = cmd.msg
+			result.trailersSet = true
+		case WSTA:
+			result.status, result.reason = parseStatus(cmd.msg)
+		case SWCH:
+			result.switched = true
+			result.status, _ = strconv.Atoi(cmd.msg)
+			// Anything written before the switch is no longer relevant.
+			result.headers = ""
+			result.headersSet = false
+			result.trailers = ""
+			result.trailersSet = false
+			result.body = nil
+			result.bodyChanged = true
+		case WBOD:
+			result.body = append(result.body, takeChunk(cmd.msg)...)
+			result.bodyChanged = true
+		}
+	}
+}
+
+/*
+ * Copy a chunk that was sent in a WBOD command and release it.
+ */
+func takeChunk(rawID string) []byte {
+	id, err := strconv.ParseInt(rawID, 16, 32)
+	if err != nil {
+		return nil
+	}
+	c := getChunk(int32(id))
+	releaseChunk(int32(id))
+	if c.data == nil {
+		return nil
+	}
+	buf := C.GoBytes(c.data, C.int(c.len))
+	C.free(c.data)
+	return buf
+}
@@ -6,13 +6,26 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/30x/gozerian/pipeline"
+	"github.com/30x/libgozerian/weaver"
 )
 
 // TestPipeDef implements gozerian PipeDefinition interface.
-type TestPipeDef struct{}
+type TestPipeDef struct {
+	capabilities Capability
+}
+
+// Capabilities returns what the test pipeline needs. By default it needs
+// everything.
+func (d *TestPipeDef) Capabilities() uint32 {
+	if d.capabilities == 0 {
+		return uint32(AllCapabilities)
+	}
+	return uint32(d.capabilities)
+}
 
 // CreatePipe creates a new pipeline.
 func (d *TestPipeDef) CreatePipe() pipeline.Pipe {
@@ -44,6 +57,26 @@ func (p *TestPipe) ResponseHandlerFunc() pipeline.ResponseHandlerFunc {
 	}
 }
 
+// LogTransaction passes the stats for "/logtransaction" to the tests.
+func (p *TestPipe) LogTransaction(req *http.Request, resp *http.Response, stats *weaver.TransactionStats) {
+	if req.URL.Path != "/logtransaction" {
+		return
+	}
+	weaver.Logf(req, weaver.LevelInfo, "Status %d", stats.Status)
+	sub, _ := http.NewRequest("GET", "http://auth.example.com/", nil)
+	_, err := weaver.Transport(req).RoundTrip(sub.WithContext(req.Context()))
+	var status int
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	testTransactions <- testTransaction{
+		req:            req,
+		stats:          stats,
+		responseStatus: status,
+		err:            err,
+	}
+}
+
 // Control is not implemented because it is not used by libgozerian, only by
 // gozerian itself, which does not invoke this particular handler.
 func (p *TestPipe) Control() pipeline.Control {
@@ -52,7 +85,17 @@ func (p *TestPipe) Control() pipeline.Control {
 }
 
 // help us a bit by saving test results for internal comparison
+type testTransaction struct {
+	req            *http.Request
+	stats          *weaver.TransactionStats
+	responseStatus int
+	err            error
+}
+
+var testTransactions = make(chan testTransaction, 1)
 var lastTestBody []byte
+var lastTestTrailers http.Header
+var lastTestRequest *http.Request
 
 func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request) {
 	switch req.URL.Path {
@@ -65,7 +108,7 @@ func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request
 	case "/readbody":
 		buf, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			fmt.Printf("Error reading body: %v\n", err)
+			weaver.Logf(req, weaver.LevelError, "Error reading body: %v", err)
 		}
 		lastTestBody = buf
 		req.Body.Close()
@@ -81,6 +124,20 @@ func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request
 		lastTestBody = buf.Bytes()
 		req.Body.Close()
 
+	case "/readtrailers":
+		ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		lastTestTrailers = copyHeaders(req.Trailer)
+
+	case "/writetrailers":
+		req.Trailer.Set("X-Apigee-Checksum", "1234")
+
+	case "/returntrailers":
+		resp.Header().Set("Trailer", "Grpc-Status")
+		resp.Write([]byte("Hello! I am the server!"))
+		resp.Header().Set("Grpc-Status", "0")
+		resp.Header().Set(http.TrailerPrefix+"Grpc-Message", "OK")
+
 	case "/readanddiscard":
 		tmp := make([]byte, 2)
 		req.Body.Read(tmp)
@@ -96,10 +153,83 @@ func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request
 		req.Header.Add("Server", "Go Test Stuff")
 		req.Header.Add("X-Apigee-Test", "HeaderTest")
 
+	case "/editheaders":
+		req.Header.Del("Content-Type")
+		req.Header.Set("Host", "example.com")
+		req.Header.Add("X-Apigee-Test", "one")
+		req.Header.Add("X-Apigee-Test", "two")
+
 	case "/writepath":
 		newURL, _ := url.Parse("/newpath")
 		req.URL = newURL
 
+	case "/writequery":
+		req.URL.RawQuery = "foo=bar"
+
+	case "/writetarget":
+		req.URL.Scheme = "https"
+		req.URL.Host = "example.com:8443"
+
+	case "/writemethod":
+		req.Method = "POST"
+
+	case "/writebadmethod":
+		req.Method = "GET /evil HTTP/1.1"
+
+	case "/writeupstream":
+		weaver.SetUpstream(req, "https://backend.example.com:8443/")
+		req.Host = "backend.example.com"
+
+	case "/writeupstreamgroup":
+		weaver.SetUpstream(req, "backends")
+
+	case "/log":
+		weaver.Logf(req, weaver.LevelInfo, "Hello,\n%s!", "World")
+		weaver.Logf(req, weaver.LevelDebug, "Nobody wants to see this")
+
+	case "/logalot":
+		for i := 0; i <= commandQueueSize; i++ {
+			weaver.Logf(req, weaver.LevelInfo, "Message %d", i)
+		}
+
+	case "/subrequest":
+		sub, _ := http.NewRequest("POST", "http://auth.example.com/check", strings.NewReader("who?"))
+		sub.Header.Set("X-Check", "yes")
+		resp, err := weaver.Transport(req).RoundTrip(sub)
+		if err != nil {
+			req.Header.Set("X-Auth-Error", err.Error())
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		req.Header.Set("X-Auth", fmt.Sprintf("%d %s", resp.StatusCode, body))
+
+	case "/redirectrequest":
+		weaver.Redirect(req, "/return201")
+		req.Header.Set("X-Redirected", "yes")
+
+	case "/redirectnamed":
+		weaver.Redirect(req, "@fallback")
+
+	case "/saverequest":
+		lastTestRequest = req
+
+	case "/injectheader":
+		req.Header.Set("X-Injected", "foo\r\nX-Evil: yes")
+
+	case "/injectheadername":
+		req.Header["X-Bad\r\nName"] = []string{"foo"}
+
+	case "/injectquery":
+		req.URL.RawQuery = "foo=bar\r\nX-Evil: yes"
+
+	case "/injectresponseheader":
+		resp.Header().Set("X-Injected", "foo\nbar")
+		resp.WriteHeader(http.StatusOK)
+
+	case "/returnbadstatus":
+		resp.WriteHeader(1)
+
 	case "/return201":
 		resp.WriteHeader(http.StatusCreated)
 
@@ -110,6 +240,27 @@ func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request
 	case "/returnbody":
 		resp.Write([]byte("Hello! I am the server!"))
 
+	case "/variables":
+		upstream, _ := weaver.Variable(req, "upstream")
+		weaver.SetVariable(req, "pipeline_result", "upstream is "+upstream)
+
+	case "/returnremoteaddr":
+		resp.Write([]byte(req.RemoteAddr))
+
+	case "/earlyhints":
+		resp.Header().Add("Link", "</style.css>; rel=preload; as=style")
+		resp.WriteHeader(http.StatusEarlyHints)
+
+	case "/continue":
+		if req.ContentLength > 100 {
+			resp.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+		if req.Header.Get("Expect") == "100-continue" {
+			resp.WriteHeader(http.StatusContinue)
+		}
+		lastTestBody, _ = ioutil.ReadAll(req.Body)
+
 	case "/completerequest":
 		newURL, _ := url.Parse("/totallynewurl")
 		req.URL = newURL
@@ -129,6 +280,19 @@ func testHandleRequest(msgID string, resp http.ResponseWriter, req *http.Request
 		resp.Write([]byte("Time for a complete rewrite!"))
 
 	case "/writeresponseheaders":
+	case "/writereason":
+	case "/injectreason":
+	case "/redirectresponse":
+	case "/redirectafterbody":
+	case "/retryonce":
+	case "/logtransaction":
+	case "/upstreamerror":
+	case "/retry":
+		if err := weaver.Retry(req, ""); err != nil {
+			req.Header.Set("X-Retry-Error", err.Error())
+		}
+	case "/readresponsetrailers":
+	case "/writeresponsetrailers":
 	case "/transformbody":
 	case "/transformbodychunks":
 	case "/responseerror":
@@ -147,6 +311,66 @@ func testHandleResponse(msgID string, w http.ResponseWriter, req *http.Request,
 	case "/writeresponseheaders":
 		resp.Header.Set("X-Apigee-ResponseHeader", "yes")
 
+	case "/writereason":
+		resp.StatusCode = 299
+		resp.Status = "299 Mostly OK"
+
+	case "/redirectresponse":
+		resp.Header.Set("X-Ignored", "yes")
+		weaver.Redirect(req, "/return201")
+
+	case "/redirectafterbody":
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err := weaver.Redirect(req, "/return201"); err != nil {
+			// The headers are gone by now.
+			weaver.SetVariable(req, "redirect_error", err.Error())
+		}
+
+	case "/retry":
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			if err := weaver.Retry(req, "https://backup.example.com"); err != nil {
+				resp.Header.Set("X-Retry-Error", err.Error())
+			}
+		}
+
+	case "/upstreamerror":
+		if failure := weaver.UpstreamFailure(req); failure != nil {
+			if failure.Kind == weaver.UpstreamTimeout {
+				weaver.Retry(req, "")
+				break
+			}
+			resp.StatusCode = http.StatusServiceUnavailable
+			resp.Status = "503 Try Again Later"
+			resp.Header.Set("Content-Type", "text/plain")
+			resp.Body = ioutil.NopCloser(
+				bytes.NewReader([]byte("Upstream failed: " + failure.Message)))
+		}
+
+	case "/retryonce":
+		if _, retried := weaver.Variable(req, "retried"); retried {
+			resp.Header.Set("X-Retried", "yes")
+		} else {
+			weaver.SetVariable(req, "retried", "yes")
+			weaver.Retry(req, "")
+		}
+
+	case "/injectreason":
+		resp.StatusCode = 299
+		resp.Status = "299 OK\r\nX-Evil: yes"
+
+	case "/variables":
+		status, _ := weaver.Variable(req, "upstream_status")
+		weaver.SetVariable(req, "response_result", "status is "+status)
+
+	case "/readresponsetrailers":
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		lastTestTrailers = copyHeaders(resp.Trailer)
+
+	case "/writeresponsetrailers":
+		resp.Trailer.Set("Grpc-Status", "0")
+
 	case "/transformbody":
 		resp.Body = ioutil.NopCloser(
 			bytes.NewReader([]byte("We have transformed the response!")))
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+/*
+ * Build the initial trailer map for a message. As in the standard "net/http"
+ * package, every trailer that was announced in the "Trailer" header has
+ * a key with no values until the body has been read. Unlike that package, the
+ * map is never nil, so that a pipeline can add trailers of its own.
+ */
+func declaredTrailers(hdr http.Header) http.Header {
+	trailers := http.Header{}
+	for _, v := range hdr["Trailer"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				trailers[http.CanonicalHeaderKey(name)] = nil
+			}
+		}
+	}
+	return trailers
+}
+
+/*
+ * Copy trailers that the caller sent with the last chunk of the body into
+ * the trailer map of the message.
+ */
+func mergeTrailers(dst http.Header, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+/*
+ * Return only the trailers that actually have values. Keys with no values
+ * are just declarations and are not sent.
+ */
+func trailerValues(trailers http.Header) http.Header {
+	vals := http.Header{}
+	for k, v := range trailers {
+		if len(v) > 0 {
+			vals[k] = v
+		}
+	}
+	return vals
+}
+
+/*
+ * Send a WTRL command if the pipeline changed the trailers since "orig" was
+ * saved. The command always contains the complete set.
+ */
+func sendTrailerChanges(h commandHandler, policy outputPolicy, orig, cur http.Header) error {
+	newVals := trailerValues(cur)
+	if reflect.DeepEqual(trailerValues(orig), newVals) {
+		return nil
+	}
+	newVals, err := policy.cleanHeaders(newVals)
+	if err != nil {
+		return err
+	}
+	h.SendCommand(command{
+		id:  WTRL,
+		msg: serializeHeaders(newVals),
+	})
+	return nil
+}
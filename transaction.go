@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/30x/libgozerian/weaver"
+)
+
+/*
+ * Once the caller has sent the whole response, it tells us how the
+ * transaction went, and pipes that implement weaver.TransactionLogger get to
+ * see it. That happens in the background, since the caller has no reason to
+ * wait.
+ */
+
+var errTransactionComplete = errors.New("The transaction is already complete")
+
+func completeTransaction(requestID, responseID uint32, stats *weaver.TransactionStats) error {
+	req := getRequest(requestID)
+	if req == nil {
+		return fmt.Errorf("Unknown request: %d", requestID)
+	}
+	var resp *http.Response
+	if responseID != 0 {
+		r := getResponse(responseID)
+		if r == nil {
+			return fmt.Errorf("Unknown response: %d", responseID)
+		}
+		if r.request != req {
+			return fmt.Errorf("Response %d does not belong to request %d", responseID, requestID)
+		}
+		resp = r.resp
+	}
+	return req.complete(resp, stats)
+}
+
+func (r *request) complete(resp *http.Response, stats *weaver.TransactionStats) error {
+	if r.pipe == nil {
+		return errors.New("Request has not been started")
+	}
+	r.latch.Lock()
+	completed := r.completed
+	r.completed = true
+	r.latch.Unlock()
+	if completed {
+		return errTransactionComplete
+	}
+	logger, ok := r.pipe.(weaver.TransactionLogger)
+	if !ok {
+		return nil
+	}
+	r.vars.setHandler(completedHandler{})
+
+	// The logger gets copies so that it can't race with anything that is
+	// still holding on to the originals, and the bodies have been consumed
+	// already.
+	req := copyRequest(r.req)
+	if resp != nil {
+		resp = copyResponse(resp)
+		resp.Request = req
+	}
+	go logger.LogTransaction(req, resp, stats)
+	return nil
+}
+
+func copyRequest(orig *http.Request) *http.Request {
+	req := *orig
+	if orig.URL != nil {
+		u := *orig.URL
+		req.URL = &u
+	}
+	req.Header = copyHeaders(orig.Header)
+	req.Trailer = copyHeaders(orig.Trailer)
+	req.Body = http.NoBody
+	return &req
+}
+
+func copyResponse(orig *http.Response) *http.Response {
+	resp := *orig
+	resp.Header = copyHeaders(orig.Header)
+	resp.Trailer = copyHeaders(orig.Trailer)
+	resp.Body = http.NoBody
+	return &resp
+}
+
+/*
+ * Nobody polls for commands once the transaction is complete, so the
+ * pipeline can't change anything any more. Log messages go to the standard
+ * logger instead, and subrequests fail.
+ */
+type completedHandler struct{}
+
+func (completedHandler) SendCommand(cmd command) {
+	switch cmd.id {
+	case WLOG:
+		_, msgID, text := parseLogMessage(cmd.msg)
+		log.Printf("%s: %s", msgID, text)
+	case SUBR:
+		rejectSubrequest(cmd.msg, errTransactionComplete)
+	}
+}
+
+func (completedHandler) Bodies() chan []byte {
+	return nil
+}
+
+func (completedHandler) Headers() http.Header {
+	return nil
+}
+
+func (completedHandler) ResponseWritten() {
+}
+
+func (completedHandler) StartRead() {
+}
+
+func (completedHandler) SetTrailers(trailers http.Header) {
+}
+
+func (completedHandler) EndRead() {
+}
+
+func (completedHandler) SetRedirect(location string) error {
+	return errTransactionComplete
+}
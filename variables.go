@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+/*
+ * Variables are shared between the caller and the pipeline for the whole
+ * transaction. The caller may set them before the request or the response
+ * starts, and when the pipeline sets one, the caller is told with a WVAR
+ * command on whichever phase is running. This implements weaver.Host.
+ */
+type variables struct {
+	latch   sync.Mutex
+	values  map[string]string
+	handler commandHandler
+	policy  outputPolicy
+}
+
+func newVariables(h commandHandler, policy outputPolicy) *variables {
+	return &variables{
+		values:  make(map[string]string),
+		handler: h,
+		policy:  policy,
+	}
+}
+
+func (v *variables) Variable(name string) (string, bool) {
+	v.latch.Lock()
+	defer v.latch.Unlock()
+	val, ok := v.values[name]
+	return val, ok
+}
+
+func (v *variables) SetVariable(name, value string) error {
+	if !isVariableName(name) {
+		return fmt.Errorf("Invalid variable name: \"%s\"", name)
+	}
+	value, err := v.policy.clean("variable value", value, isHeaderValueChar)
+	if err != nil {
+		return err
+	}
+	v.latch.Lock()
+	v.values[name] = value
+	v.latch.Unlock()
+
+	v.currentHandler().SendCommand(makeHeaderCommand(WVAR, name, value))
+	return nil
+}
+
+/*
+ * Set a variable on behalf of the caller. There's no need to tell the caller.
+ */
+func (v *variables) set(name, value string) error {
+	if !isVariableName(name) {
+		return fmt.Errorf("Invalid variable name: \"%s\"", name)
+	}
+	v.latch.Lock()
+	v.values[name] = value
+	v.latch.Unlock()
+	return nil
+}
+
+/*
+ * Send commands for variables to a different phase of the transaction.
+ */
+func (v *variables) setHandler(h commandHandler) {
+	v.latch.Lock()
+	v.handler = h
+	v.latch.Unlock()
+}
+
+func (v *variables) currentHandler() commandHandler {
+	v.latch.Lock()
+	defer v.latch.Unlock()
+	return v.handler
+}
+
+/*
+ * Variable names go in the same place as header names in WVAR.
+ */
+func isVariableName(name string) bool {
+	return name != "" && tokenLength(name) == len(name)
+}
@@ -0,0 +1,280 @@
+/*
+Package weaver lets pipelines that run inside libgozerian talk to the
+program that is calling it, such as an Nginx module. libgozerian itself
+builds as a C shared library, so it can't be imported, but pipelines may
+import this package instead.
+
+Every request that libgozerian passes to a pipeline has a Host in its
+context. The functions in this package look it up, so a pipeline that runs
+somewhere else just sees that there is no host.
+*/
+package weaver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ErrNoHost is returned when a request was not passed to the pipeline by
+// libgozerian, so there is nobody to talk to.
+var ErrNoHost = errors.New("Request has no host")
+
+// Level is the severity of a log message. Lower levels are more severe.
+type Level int
+
+// The log levels, which match the GO_LOG_ constants in the C API.
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+// UpstreamErrorKind says why the caller could not get a response from the
+// upstream server.
+type UpstreamErrorKind int
+
+// The kinds of upstream error, which match the GO_UPSTREAM_ constants in the
+// C API.
+const (
+	// The caller could not connect to the upstream server, or the connection
+	// failed before there was a response.
+	UpstreamUnreachable UpstreamErrorKind = iota
+	// The upstream server did not respond in time.
+	UpstreamTimeout
+	// The upstream server sent a response that the caller could not parse.
+	UpstreamInvalidResponse
+)
+
+/*
+UpstreamError describes why the caller could not get a response from the
+upstream server. Message comes from the caller, and is meant for logs rather
+than for clients.
+*/
+type UpstreamError struct {
+	Kind    UpstreamErrorKind
+	Message string
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Message
+}
+
+/*
+Host is implemented by libgozerian for every request.
+*/
+type Host interface {
+	// Variable returns the value of a variable that was set by the caller
+	// or by the pipeline, and whether it was set at all.
+	Variable(name string) (string, bool)
+	// SetVariable sets a variable and passes it back to the caller. It
+	// returns an error if the name is not valid, or if the value contains
+	// characters that the caller does not allow.
+	SetVariable(name, value string) error
+	// SetUpstream sends the request to a different upstream server. It
+	// returns an error if the target is not valid or if the request has
+	// already been sent.
+	SetUpstream(target string) error
+	// Log sends a message to the log of the caller, along with the ID of
+	// the request.
+	Log(level Level, text string)
+	// Redirect asks the caller to hand the request to a different location
+	// once the pipeline is done with the current phase.
+	Redirect(location string) error
+	// Retry asks the caller to throw away the response and send the request
+	// to the target again, or to a different target if one is given.
+	Retry(target string) error
+	// UpstreamFailure returns why the caller could not get a response from
+	// the upstream server, or nil if the response is a real one.
+	UpstreamFailure() *UpstreamError
+	// RoundTrip asks the caller to make an HTTP request, using its own
+	// connections to other servers, and waits for the response.
+	http.RoundTripper
+}
+
+/*
+TransactionStats describes a transaction once the caller has sent the whole
+response to the client.
+*/
+type TransactionStats struct {
+	// Status is the status code that the client got.
+	Status int
+	// BytesReceived is the size of the request from the client, including
+	// the headers.
+	BytesReceived int64
+	// BytesSent is the size of the response to the client, including the
+	// headers.
+	BytesSent int64
+	// UpstreamTime is how long the upstream server took to respond, or -1
+	// if the request never went there.
+	UpstreamTime time.Duration
+	// RequestTime is how long it took from the first byte of the request to
+	// the last byte of the response.
+	RequestTime time.Duration
+}
+
+/*
+TransactionLogger may be implemented by a pipeline.Pipe that wants to see
+each transaction once it is complete, for instance to record analytics.
+LogTransaction runs in a goroutine of its own after the caller has sent the
+response, so it never delays the client. By then the pipeline can no longer
+change anything, the request and response are copies whose bodies are
+empty, and log messages go to the standard logger. The response is nil if
+there was no response phase.
+*/
+type TransactionLogger interface {
+	LogTransaction(req *http.Request, resp *http.Response, stats *TransactionStats)
+}
+
+type contextKey struct {
+	name string
+}
+
+var hostKey = &contextKey{"weaver-host"}
+
+/*
+NewContext returns a context that contains the host.
+*/
+func NewContext(ctx context.Context, h Host) context.Context {
+	return context.WithValue(ctx, hostKey, h)
+}
+
+/*
+FromContext returns the host from a context, if there is one.
+*/
+func FromContext(ctx context.Context) (Host, bool) {
+	h, ok := ctx.Value(hostKey).(Host)
+	return h, ok
+}
+
+/*
+Variable returns the value of a variable for a request. It returns false
+if the variable is not set or there is no host.
+*/
+func Variable(req *http.Request, name string) (string, bool) {
+	h, ok := FromContext(req.Context())
+	if !ok {
+		return "", false
+	}
+	return h.Variable(name)
+}
+
+/*
+SetVariable sets a variable for a request. It returns ErrNoHost if the
+request did not come from libgozerian.
+*/
+func SetVariable(req *http.Request, name, value string) error {
+	h, ok := FromContext(req.Context())
+	if !ok {
+		return ErrNoHost
+	}
+	return h.SetVariable(name, value)
+}
+
+/*
+SetUpstream chooses the upstream server for a request, without changing its
+URI. The target is either a scheme, host and optional port, such as
+"https://example.com:8443", or the name of a group of servers that the
+caller knows about. The Host header does not change unless the pipeline
+also sets req.Host. It returns ErrNoHost if the request did not come from
+libgozerian.
+*/
+func SetUpstream(req *http.Request, target string) error {
+	h, ok := FromContext(req.Context())
+	if !ok {
+		return ErrNoHost
+	}
+	return h.SetUpstream(target)
+}
+
+/*
+Logf formats a log message for a request and sends it to the log of the
+caller, if the caller wants messages at that level. If the request did not
+come from libgozerian, then the message goes to the standard logger.
+*/
+func Logf(req *http.Request, level Level, format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	h, ok := FromContext(req.Context())
+	if !ok {
+		log.Print(text)
+		return
+	}
+	h.Log(level, text)
+}
+
+/*
+Redirect asks the caller to hand the request to a different location of its
+own once the pipeline is done, which is known as an internal redirect. The
+location is either a path, such as "/fallback", or the name of a location
+that the caller knows about, starting with "@". During the request, the
+other changes to the request still apply at the new location, unless the
+pipeline also writes a response. During the response, the response from the
+target is thrown away, so it fails once the pipeline has started to read or
+write the response body. It returns ErrNoHost if the request did not come
+from libgozerian.
+*/
+func Redirect(req *http.Request, location string) error {
+	h, ok := FromContext(req.Context())
+	if !ok {
+		return ErrNoHost
+	}
+	return h.Redirect(location)
+}
+
+/*
+Retry asks the caller to throw away the response that the pipeline is
+handling and to send the request again, for instance because the target
+returned a 503 error. The target is in the same format as for SetUpstream,
+and if it is empty, the request goes to the same upstream as before. The
+caller then starts a new response phase for the new response. It returns an
+error if it is not called during the response, or if the request has already
+been retried as many times as the caller allows.
+*/
+func Retry(req *http.Request, target string) error {
+	h, ok := FromContext(req.Context())
+	if !ok {
+		return ErrNoHost
+	}
+	return h.Retry(target)
+}
+
+/*
+UpstreamFailure tells a response handler whether the response really came
+from the upstream server. If the caller could not get one at all, the
+handler sees an empty response with a 502 or 504 status, so that it can
+replace it with an error of its own or call Retry. Then UpstreamFailure
+returns the reason, and otherwise it returns nil, as it does if the request
+did not come from libgozerian.
+*/
+func UpstreamFailure(req *http.Request) *UpstreamError {
+	h, ok := FromContext(req.Context())
+	if !ok {
+		return nil
+	}
+	return h.UpstreamFailure()
+}
+
+/*
+Transport returns an http.RoundTripper that makes requests through the caller
+of the pipeline, for use in an http.Client. Each request that it makes waits
+until the caller has the whole response, so it is best used for small
+requests to other services. If the request did not come from libgozerian,
+then every request fails with ErrNoHost.
+*/
+func Transport(req *http.Request) http.RoundTripper {
+	h, ok := FromContext(req.Context())
+	if !ok {
+		return noHostTransport{}
+	}
+	return h
+}
+
+type noHostTransport struct{}
+
+func (noHostTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, ErrNoHost
+}